@@ -1,14 +1,22 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
+	"github.com/netraitcorp/netick/pkg/admin"
+	"github.com/netraitcorp/netick/pkg/config"
 	"github.com/netraitcorp/netick/pkg/types"
 
 	"github.com/netraitcorp/netick/pkg/log"
+	"github.com/netraitcorp/netick/pkg/metrics"
 	"github.com/netraitcorp/netick/pkg/server"
+	"github.com/netraitcorp/netick/pkg/store"
 )
 
 const (
@@ -29,6 +37,7 @@ Usage: %s [OPTIONS]
 
 Options:
   -a, --addr <host>        Server running address (default: 0.0.0.0:2634)
+  -t, --tcp <host>         TCP server running address (default: 0.0.0.0:2635)
   -c, --config <file>      Configuration file (default: ./netick.yaml)
   --dev                    Starts the server in development mode
   -v, --version            Show version
@@ -39,8 +48,13 @@ var (
 	showHelpFlag    bool
 	showVersionFlag bool
 	addressFlag     string
+	tcpAddressFlag  string
 	configFlag      string
 	envDevelopFlag  bool
+
+	// flags given explicitly on the command line, they take precedence over
+	// the values of the configuration file
+	setFlags = make(map[string]bool)
 )
 
 func usage() {
@@ -53,6 +67,8 @@ func parseFlags() error {
 
 	usaf.StringVar(&addressFlag, "a", "0.0.0.0:2634", "Server running address")
 	usaf.StringVar(&addressFlag, "addr", "0.0.0.0:2634", "Server running address")
+	usaf.StringVar(&tcpAddressFlag, "t", "0.0.0.0:2635", "TCP server running address")
+	usaf.StringVar(&tcpAddressFlag, "tcp", "0.0.0.0:2635", "TCP server running address")
 	usaf.StringVar(&configFlag, "config", "./netick.yaml", "Configuration file")
 	usaf.StringVar(&configFlag, "c", "./netick.yaml", "Configuration file")
 	usaf.BoolVar(&showHelpFlag, "help", false, "Show this help")
@@ -78,12 +94,48 @@ func parseFlags() error {
 		os.Exit(0)
 	}
 
-	welcome()
+	usaf.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
 
 	return nil
 }
 
-func welcome() {
+func flagSet(names ...string) bool {
+	for _, name := range names {
+		if setFlags[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// loadConfig reads the configuration file, it is required since the
+// authentication must be configured explicitly.
+func loadConfig() (*config.Config, error) {
+	cfg, err := config.Load(configFlag)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("configuration file %s not found, it must set auth.password or auth.method", configFlag)
+		}
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func applyFlags(cfg *config.Config) {
+	if flagSet("a", "addr") {
+		cfg.Server.Websocket.Addr = addressFlag
+	}
+	if flagSet("t", "tcp") {
+		cfg.Server.TCP.Addr = tcpAddressFlag
+	}
+	if flagSet("dev") {
+		cfg.Log.Env = types.EnvDev
+	}
+}
+
+func welcome(cfg *config.Config) {
 	fmt.Println("   _  __      __   _       __")
 	fmt.Println("  / |/ /___  / /_ (_)____ / /__")
 	fmt.Println(" /    // -_)/ __// // __//  '_/")
@@ -91,29 +143,147 @@ func welcome() {
 	fmt.Println("")
 	log.StdInfo("Version is %s", appVersion)
 	log.StdInfo("Configuration loaded from file %s", configFlag)
-	log.StdInfo("Started Websocket Server on %s", addressFlag)
-	if envDevelopFlag {
+	log.StdInfo("Started Websocket Server on %s", cfg.Server.Websocket.Addr)
+	log.StdInfo("Started TCP Server on %s", cfg.Server.TCP.Addr)
+	if cfg.Metrics.Addr != "" {
+		log.StdInfo("Started Metrics Server on %s%s", cfg.Metrics.Addr, cfg.Metrics.Path)
+	}
+	if cfg.Admin.Addr != "" {
+		log.StdInfo("Started Admin Server on %s", cfg.Admin.Addr)
+	}
+	if cfg.Storage.Dir != "" {
+		log.StdInfo("Durable message log in %s", cfg.Storage.Dir)
+	}
+	if cfg.Log.Env == types.EnvDev {
 		log.StdInfo("Starts the server in development mode")
 	}
 	log.StdInfo("Server is ready")
 }
 
+func handleReload(reloader *config.Reloader) {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGHUP)
+
+	for range sigc {
+		reload(reloader)
+	}
+}
+
+func reload(reloader *config.Reloader) {
+	restart, err := reloader.Reload()
+	if err != nil {
+		log.Error("Reload configuration failed, keep running with the previous one: %s", err.Error())
+		return
+	}
+	log.Info("Configuration reloaded from file %s", configFlag)
+	if len(restart) > 0 {
+		log.Warn("Configuration changes require a restart to take effect: %s", strings.Join(restart, ", "))
+	}
+}
+
 func main() {
 	if err := parseFlags(); err != nil {
 		os.Exit(2)
 	}
 
-	configOpts := log.NewOptions()
-	if envDevelopFlag {
-		configOpts.Env = types.EnvDev
+	cfg, err := loadConfig()
+	if err != nil {
+		log.StdError("%s", err.Error())
+		os.Exit(2)
 	}
-	configOpts.Level = "debug"
-	log.Init(configOpts)
+	applyFlags(cfg)
 
-	srvOpts := server.NewOptions()
-	srvOpts.Websocket.Addr = addressFlag
+	log.Init(cfg.Log)
+	server.Configure(cfg.Server)
 
-	if err := server.RunWebsocketServer(srvOpts); err != nil {
-		log.Fatal("websocket server run error: %s\n", err.Error())
+	var journal *store.Log
+	if cfg.Storage.Dir != "" {
+		if journal, err = store.Open(cfg.Storage); err == nil {
+			err = server.Restore(journal)
+		}
+		if err != nil {
+			log.StdError("Open durable message log failed: %s", err.Error())
+			os.Exit(1)
+		}
 	}
+	welcome(cfg)
+
+	srvOpts := cfg.Server
+	wsSrv := server.NewWebsocketServer(srvOpts)
+	tcpSrv := server.NewTCPServer(srvOpts)
+	metricsSrv := metrics.NewServer(cfg.Metrics)
+
+	reloader := config.NewReloader(configFlag, cfg, applyFlags, wsSrv, tcpSrv)
+	go handleReload(reloader)
+	adminSrv := admin.NewServer(cfg.Admin, reloader)
+
+	errc := make(chan error, 4)
+	go func() {
+		if err := wsSrv.ListenAndServe(); err != nil {
+			errc <- fmt.Errorf("websocket server run error: %s", err.Error())
+		}
+	}()
+	go func() {
+		if err := tcpSrv.ListenAndServe(); err != nil {
+			errc <- fmt.Errorf("tcp server run error: %s", err.Error())
+		}
+	}()
+
+	if cfg.Metrics.Addr != "" {
+		go func() {
+			if err := metricsSrv.ListenAndServe(); err != nil {
+				errc <- fmt.Errorf("metrics server run error: %s", err.Error())
+			}
+		}()
+	}
+
+	if cfg.Admin.Addr != "" {
+		go func() {
+			if err := adminSrv.ListenAndServe(); err != nil {
+				errc <- fmt.Errorf("admin server run error: %s", err.Error())
+			}
+		}()
+	}
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case err = <-errc:
+		log.Fatal("%s\n", err.Error())
+	case sig := <-sigc:
+		log.Info("Received signal %s, shutting down", sig.String())
+		shutdown(reloader.Config().Server.Shutdown, wsSrv, tcpSrv, metricsSrv, adminSrv, journal)
+	}
+}
+
+// shutdown stops accepting connections and drains the established ones,
+// bounded by the configured timeout.
+func shutdown(opts *server.ShutdownOptions, wsSrv *server.WebsocketServer, tcpSrv *server.TCPServer,
+	metricsSrv *metrics.Server, adminSrv *admin.Server, journal *store.Log) {
+	ctx, cancel := context.WithTimeout(context.Background(), opts.Timeout)
+	defer cancel()
+
+	if err := wsSrv.Shutdown(ctx); err != nil {
+		log.Error("Websocket server shutdown error: %s", err.Error())
+	}
+	if err := tcpSrv.Shutdown(ctx); err != nil {
+		log.Error("TCP server shutdown error: %s", err.Error())
+	}
+	server.DrainConns(ctx, opts.ReconnectAfter)
+	if err := metricsSrv.Shutdown(ctx); err != nil {
+		log.Error("Metrics server shutdown error: %s", err.Error())
+	}
+	if err := adminSrv.Shutdown(ctx); err != nil {
+		log.Error("Admin server shutdown error: %s", err.Error())
+	}
+
+	if journal != nil {
+		if err := journal.Close(); err != nil {
+			log.Error("Durable message log close error: %s", err.Error())
+		}
+	}
+
+	log.Info("Server stopped")
+	_ = log.Sync()
 }
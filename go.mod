@@ -3,9 +3,13 @@ module github.com/netraitcorp/netick
 go 1.14
 
 require (
+	github.com/golang-jwt/jwt/v4 v4.5.2
 	github.com/golang/protobuf v1.4.2
+	github.com/golang/snappy v0.0.4
 	github.com/gorilla/websocket v1.4.2
+	github.com/prometheus/client_golang v1.7.0
 	go.uber.org/zap v1.15.0
 	google.golang.org/protobuf v1.25.0
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,261 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/netraitcorp/netick/pkg/log"
+	"github.com/netraitcorp/netick/pkg/server"
+)
+
+type Options struct {
+	// Addr of the HTTP listener, empty disables it.
+	Addr string
+	// Token must be sent by clients as "Authorization: Bearer <token>".
+	Token string
+	TLS   *server.TLSOptions
+}
+
+func NewOptions() *Options {
+	return &Options{}
+}
+
+// Reloader applies the configuration file to the running servers and
+// returns the changed keys that require a restart.
+type Reloader interface {
+	Reload() ([]string, error)
+}
+
+// Server serves the admin API:
+//
+//	GET  /connections                  live connections
+//	GET  /connections/<conn_id>        a single connection
+//	POST /connections/kick             {"conn_id", "reason"}
+//	POST /connections/unsubscribe      {"conn_id", "topic"}
+//	GET  /topics                       topics with their subscriber counts
+//	POST /publish                      {"subject", "data", "retain"}, data is base64
+//	POST /retained/clear               {"subject"}
+//	POST /reload                       reload the configuration file
+type Server struct {
+	opts     *Options
+	reloader Reloader
+	httpSrv  *http.Server
+	mu       sync.Mutex
+}
+
+func NewServer(opts *Options, reloader Reloader) *Server {
+	return &Server{
+		opts:     opts,
+		reloader: reloader,
+	}
+}
+
+func (srv *Server) ListenAndServe() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/connections", srv.method(http.MethodGet, srv.listConns))
+	mux.HandleFunc("/connections/", srv.method(http.MethodGet, srv.getConn))
+	mux.HandleFunc("/connections/kick", srv.method(http.MethodPost, srv.kick))
+	mux.HandleFunc("/connections/unsubscribe", srv.method(http.MethodPost, srv.unsubscribe))
+	mux.HandleFunc("/topics", srv.method(http.MethodGet, srv.listTopics))
+	mux.HandleFunc("/publish", srv.method(http.MethodPost, srv.publish))
+	mux.HandleFunc("/retained/clear", srv.method(http.MethodPost, srv.clearRetained))
+	mux.HandleFunc("/reload", srv.method(http.MethodPost, srv.reload))
+
+	httpSrv := &http.Server{
+		Addr:    srv.opts.Addr,
+		Handler: srv.authorize(mux),
+	}
+	if srv.opts.TLS != nil {
+		cfg, err := srv.opts.TLS.TLSConfig()
+		if err != nil {
+			return err
+		}
+		httpSrv.TLSConfig = cfg
+	}
+
+	srv.mu.Lock()
+	srv.httpSrv = httpSrv
+	srv.mu.Unlock()
+
+	var err error
+	if httpSrv.TLSConfig != nil {
+		err = httpSrv.ListenAndServeTLS("", "")
+	} else {
+		err = httpSrv.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.mu.Lock()
+	httpSrv := srv.httpSrv
+	srv.mu.Unlock()
+
+	if httpSrv == nil {
+		return nil
+	}
+	return httpSrv.Shutdown(ctx)
+}
+
+func (srv *Server) authorize(next http.Handler) http.Handler {
+	want := []byte("Bearer " + srv.opts.Token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("unauthorized"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (srv *Server) method(method string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (srv *Server) listConns(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, server.ListConns())
+}
+
+func (srv *Server) getConn(w http.ResponseWriter, r *http.Request) {
+	cid := strings.TrimPrefix(r.URL.Path, "/connections/")
+	conn, err := server.GetConn(cid)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, conn)
+}
+
+func (srv *Server) kick(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ConnID string `json:"conn_id"`
+		Reason string `json:"reason"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Reason == "" {
+		req.Reason = "disconnected by administrator"
+	}
+	if err := server.Kick(req.ConnID, req.Reason); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	log.Info("Admin: kicked connection, cid: %s, remote: %s", req.ConnID, r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (srv *Server) unsubscribe(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ConnID string `json:"conn_id"`
+		Topic  string `json:"topic"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	ok, err := server.ForceUnsubscribe(req.ConnID, req.Topic)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("connection not subscribed to %q", req.Topic))
+		return
+	}
+	log.Info("Admin: unsubscribed connection, topic: %s, cid: %s, remote: %s", req.Topic, req.ConnID, r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (srv *Server) listTopics(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, server.ListTopics())
+}
+
+func (srv *Server) publish(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Subject string `json:"subject"`
+		Data    []byte `json:"data"`
+		Retain  bool   `json:"retain"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if err := server.Publish(req.Subject, req.Data, req.Retain); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (srv *Server) clearRetained(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Subject string `json:"subject"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if !server.ClearRetained(req.Subject) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no retained value for %q", req.Subject))
+		return
+	}
+	log.Info("Admin: cleared retained value, subject: %s, remote: %s", req.Subject, r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (srv *Server) reload(w http.ResponseWriter, r *http.Request) {
+	restart, err := srv.reloader.Reload()
+	if err != nil {
+		log.Error("Admin: reload configuration failed, keep running with the previous one: %s", err.Error())
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	log.Info("Admin: configuration reloaded, remote: %s", r.RemoteAddr)
+	if len(restart) > 0 {
+		log.Warn("Configuration changes require a restart to take effect: %s", strings.Join(restart, ", "))
+	}
+	if restart == nil {
+		restart = []string{}
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"restart_required": restart})
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %s", err.Error()))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	// subjects contain > which is escaped by default
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		log.Warn("Admin: write response failed, err: %s", err.Error())
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
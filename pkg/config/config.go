@@ -0,0 +1,701 @@
+package config
+
+import (
+	"compress/flate"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/netraitcorp/netick/pkg/admin"
+	"github.com/netraitcorp/netick/pkg/log"
+	"github.com/netraitcorp/netick/pkg/metrics"
+	"github.com/netraitcorp/netick/pkg/server"
+	"github.com/netraitcorp/netick/pkg/store"
+	"github.com/netraitcorp/netick/pkg/types"
+	"gopkg.in/yaml.v2"
+)
+
+// maxFrameSize is the largest frame length the TCP header can carry.
+const maxFrameSize = server.HeadCompressedFlag - 1
+
+// Config is the runtime configuration assembled from the defaults of every
+// package and the values found in the configuration file.
+type Config struct {
+	Server  *server.Options
+	Log     *log.Options
+	Metrics *metrics.Options
+	Admin   *admin.Options
+	Storage *store.Options
+}
+
+// Error reports an invalid value, Key is the dotted path of the offending
+// entry in the configuration file, e.g. "websocket.read_timeout".
+type Error struct {
+	Key string
+	Err error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("config: %s: %s", e.Key, e.Err.Error())
+}
+
+type file struct {
+	PingInterval    *string           `yaml:"ping_interval"`
+	MaxPingOutTimes *int              `yaml:"max_ping_out_times"`
+	MaxFrameSize    *int              `yaml:"max_frame_size"`
+	Websocket       *websocketFile    `yaml:"websocket"`
+	TCP             *tcpFile          `yaml:"tcp"`
+	Auth            *authFile         `yaml:"auth"`
+	Shutdown        *shutdownFile     `yaml:"shutdown"`
+	Compression     *compressionFile  `yaml:"compression"`
+	Batch           *batchFile        `yaml:"batch"`
+	SlowConsumer    *slowConsumerFile `yaml:"slow_consumer"`
+	History         *historyFile      `yaml:"history"`
+	Retain          *retainFile       `yaml:"retain"`
+	Durable         *durableFile      `yaml:"durable"`
+	Session         *sessionFile      `yaml:"session"`
+	Metrics         *metricsFile      `yaml:"metrics"`
+	Admin           *adminFile        `yaml:"admin"`
+	Storage         *storageFile      `yaml:"storage"`
+	Log             *logFile          `yaml:"log"`
+}
+
+type websocketFile struct {
+	Addr         *string  `yaml:"addr"`
+	ReadTimeout  *string  `yaml:"read_timeout"`
+	WriteTimeout *string  `yaml:"write_timeout"`
+	TLS          *tlsFile `yaml:"tls"`
+	AppPing      *bool    `yaml:"app_ping"`
+}
+
+type tcpFile struct {
+	Addr *string  `yaml:"addr"`
+	TLS  *tlsFile `yaml:"tls"`
+}
+
+type tlsFile struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	CAFile   string `yaml:"ca_file"`
+	Verify   bool   `yaml:"verify"`
+}
+
+type authFile struct {
+	Timeout  *string  `yaml:"timeout"`
+	Method   *string  `yaml:"method"`
+	Password *string  `yaml:"password"`
+	JWT      *jwtFile `yaml:"jwt"`
+
+	Permissions        map[string]*permissionsFile `yaml:"permissions"`
+	DefaultPermissions *permissionsFile            `yaml:"default_permissions"`
+}
+
+type permissionsFile struct {
+	Publish   []string `yaml:"publish"`
+	Subscribe []string `yaml:"subscribe"`
+}
+
+type jwtFile struct {
+	Algorithms    []string `yaml:"algorithms"`
+	Secret        string   `yaml:"secret"`
+	PublicKeyFile string   `yaml:"public_key_file"`
+	JWKSFile      string   `yaml:"jwks_file"`
+	Issuer        string   `yaml:"issuer"`
+	Audience      string   `yaml:"audience"`
+	Leeway        *string  `yaml:"leeway"`
+	IdentityClaim string   `yaml:"identity_claim"`
+}
+
+type shutdownFile struct {
+	Timeout        *string `yaml:"timeout"`
+	ReconnectAfter *string `yaml:"reconnect_after"`
+}
+
+type compressionFile struct {
+	Threshold *int `yaml:"threshold"`
+	Level     *int `yaml:"level"`
+}
+
+type batchFile struct {
+	MaxSize *int    `yaml:"max_size"`
+	Linger  *string `yaml:"linger"`
+}
+
+type slowConsumerFile struct {
+	MaxMessages  *int               `yaml:"max_messages"`
+	MaxBytes     *int               `yaml:"max_bytes"`
+	Policy       *string            `yaml:"policy"`
+	BlockTimeout *string            `yaml:"block_timeout"`
+	Topics       []*topicPolicyFile `yaml:"topics"`
+}
+
+type historyFile struct {
+	MaxMessages *int    `yaml:"max_messages"`
+	MaxBytes    *int    `yaml:"max_bytes"`
+	MaxAge      *string `yaml:"max_age"`
+}
+
+type retainFile struct {
+	KeepWithoutSubscribers *bool `yaml:"keep_without_subscribers"`
+}
+
+type durableFile struct {
+	MaxPending      *int    `yaml:"max_pending"`
+	MaxPendingBytes *int    `yaml:"max_pending_bytes"`
+	Expire          *string `yaml:"expire"`
+}
+
+type sessionFile struct {
+	Grace            *string `yaml:"grace"`
+	MaxBuffered      *int    `yaml:"max_buffered"`
+	MaxBufferedBytes *int    `yaml:"max_buffered_bytes"`
+}
+
+type topicPolicyFile struct {
+	Subject string `yaml:"subject"`
+	Policy  string `yaml:"policy"`
+}
+
+type storageFile struct {
+	Dir          *string `yaml:"dir"`
+	SegmentSize  *int64  `yaml:"segment_size"`
+	MaxBytes     *int64  `yaml:"max_bytes"`
+	MaxAge       *string `yaml:"max_age"`
+	Sync         *string `yaml:"sync"`
+	SyncInterval *string `yaml:"sync_interval"`
+}
+
+type metricsFile struct {
+	Addr *string `yaml:"addr"`
+	Path *string `yaml:"path"`
+}
+
+type adminFile struct {
+	Addr  *string  `yaml:"addr"`
+	Token *string  `yaml:"token"`
+	TLS   *tlsFile `yaml:"tls"`
+}
+
+type logFile struct {
+	Env        *string `yaml:"env"`
+	Filename   *string `yaml:"filename"`
+	MaxSize    *int    `yaml:"max_size"`
+	MaxAge     *int    `yaml:"max_age"`
+	MaxBackups *int    `yaml:"max_backups"`
+	Compress   *bool   `yaml:"compress"`
+	LocalTime  *bool   `yaml:"local_time"`
+	Level      *string `yaml:"level"`
+}
+
+func New() *Config {
+	return &Config{
+		Server:  server.NewOptions(),
+		Log:     log.NewOptions(),
+		Metrics: metrics.NewOptions(),
+		Admin:   admin.NewOptions(),
+		Storage: store.NewOptions(),
+	}
+}
+
+// Load reads the YAML file and applies it on top of the defaults, unknown keys
+// are rejected so that typos do not go unnoticed.
+func Load(filename string) (*Config, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+func Parse(data []byte) (*Config, error) {
+	var f file
+	if err := yaml.UnmarshalStrict(data, &f); err != nil {
+		return nil, fmt.Errorf("config: %s", err.Error())
+	}
+
+	cfg := New()
+	if err := f.apply(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (f *file) apply(cfg *Config) error {
+	opts := cfg.Server
+	if err := setDuration(&opts.PingInterval, f.PingInterval, "ping_interval"); err != nil {
+		return err
+	}
+	if f.MaxPingOutTimes != nil {
+		if *f.MaxPingOutTimes < 1 {
+			return &Error{Key: "max_ping_out_times", Err: fmt.Errorf("must be at least 1, got %d", *f.MaxPingOutTimes)}
+		}
+		opts.MaxPingOutTimes = *f.MaxPingOutTimes
+	}
+	if f.MaxFrameSize != nil {
+		if *f.MaxFrameSize < 1 || *f.MaxFrameSize > maxFrameSize {
+			return &Error{Key: "max_frame_size", Err: fmt.Errorf("must be between 1 and %d, got %d", maxFrameSize, *f.MaxFrameSize)}
+		}
+		opts.MaxFrameSize = *f.MaxFrameSize
+	}
+
+	if ws := f.Websocket; ws != nil {
+		if err := setAddr(&opts.Websocket.Addr, ws.Addr, "websocket.addr"); err != nil {
+			return err
+		}
+		if err := setDuration(&opts.Websocket.ReadTimeout, ws.ReadTimeout, "websocket.read_timeout"); err != nil {
+			return err
+		}
+		if err := setDuration(&opts.Websocket.WriteTimeout, ws.WriteTimeout, "websocket.write_timeout"); err != nil {
+			return err
+		}
+		if err := ws.TLS.apply(&opts.Websocket.TLS, "websocket.tls"); err != nil {
+			return err
+		}
+		if ws.AppPing != nil {
+			opts.Websocket.AppPing = *ws.AppPing
+		}
+	}
+
+	if tcp := f.TCP; tcp != nil {
+		if err := setAddr(&opts.TCP.Addr, tcp.Addr, "tcp.addr"); err != nil {
+			return err
+		}
+		if err := tcp.TLS.apply(&opts.TCP.TLS, "tcp.tls"); err != nil {
+			return err
+		}
+	}
+
+	// authentication is never left to a default, the file must choose a
+	// password or a method
+	auth := f.Auth
+	if auth == nil {
+		auth = &authFile{}
+	}
+	if err := setDuration(&opts.Auth.Timeout, auth.Timeout, "auth.timeout"); err != nil {
+		return err
+	}
+	if auth.Password != nil {
+		opts.Auth.Password = *auth.Password
+	}
+	if err := auth.applyMethod(opts.Auth); err != nil {
+		return err
+	}
+	if err := auth.applyPermissions(opts.Auth); err != nil {
+		return err
+	}
+
+	if sd := f.Shutdown; sd != nil {
+		if err := setDuration(&opts.Shutdown.Timeout, sd.Timeout, "shutdown.timeout"); err != nil {
+			return err
+		}
+		if err := setDuration(&opts.Shutdown.ReconnectAfter, sd.ReconnectAfter, "shutdown.reconnect_after"); err != nil {
+			return err
+		}
+	}
+
+	if c := f.Compression; c != nil {
+		if err := setNonNegative(&opts.Compression.Threshold, c.Threshold, "compression.threshold"); err != nil {
+			return err
+		}
+		if c.Level != nil {
+			if *c.Level < flate.HuffmanOnly || *c.Level > flate.BestCompression {
+				return &Error{Key: "compression.level", Err: fmt.Errorf("must be between %d and %d, got %d",
+					flate.HuffmanOnly, flate.BestCompression, *c.Level)}
+			}
+			opts.Compression.Level = *c.Level
+		}
+	}
+
+	if b := f.Batch; b != nil {
+		if err := setNonNegative(&opts.Batch.MaxSize, b.MaxSize, "batch.max_size"); err != nil {
+			return err
+		}
+		if err := setNonNegativeDuration(&opts.Batch.Linger, b.Linger, "batch.linger"); err != nil {
+			return err
+		}
+	}
+
+	if sc := f.SlowConsumer; sc != nil {
+		if err := sc.apply(opts.SlowConsumer); err != nil {
+			return err
+		}
+	}
+
+	if h := f.History; h != nil {
+		if err := setNonNegative(&opts.History.MaxMessages, h.MaxMessages, "history.max_messages"); err != nil {
+			return err
+		}
+		if err := setNonNegative(&opts.History.MaxBytes, h.MaxBytes, "history.max_bytes"); err != nil {
+			return err
+		}
+		if err := setNonNegativeDuration(&opts.History.MaxAge, h.MaxAge, "history.max_age"); err != nil {
+			return err
+		}
+	}
+
+	if r := f.Retain; r != nil && r.KeepWithoutSubscribers != nil {
+		opts.Retain.KeepWithoutSubscribers = *r.KeepWithoutSubscribers
+	}
+
+	if d := f.Durable; d != nil {
+		if err := setNonNegative(&opts.Durable.MaxPending, d.MaxPending, "durable.max_pending"); err != nil {
+			return err
+		}
+		if err := setNonNegative(&opts.Durable.MaxPendingBytes, d.MaxPendingBytes, "durable.max_pending_bytes"); err != nil {
+			return err
+		}
+		if err := setNonNegativeDuration(&opts.Durable.Expire, d.Expire, "durable.expire"); err != nil {
+			return err
+		}
+	}
+
+	if se := f.Session; se != nil {
+		if err := setNonNegativeDuration(&opts.Session.Grace, se.Grace, "session.grace"); err != nil {
+			return err
+		}
+		if err := setNonNegative(&opts.Session.MaxBuffered, se.MaxBuffered, "session.max_buffered"); err != nil {
+			return err
+		}
+		if err := setNonNegative(&opts.Session.MaxBufferedBytes, se.MaxBufferedBytes, "session.max_buffered_bytes"); err != nil {
+			return err
+		}
+	}
+
+	if m := f.Metrics; m != nil {
+		if m.Addr != nil && *m.Addr != "" {
+			if err := setAddr(&cfg.Metrics.Addr, m.Addr, "metrics.addr"); err != nil {
+				return err
+			}
+		}
+		if m.Path != nil {
+			if !strings.HasPrefix(*m.Path, "/") {
+				return &Error{Key: "metrics.path", Err: fmt.Errorf("must start with /, got %q", *m.Path)}
+			}
+			cfg.Metrics.Path = *m.Path
+		}
+	}
+
+	if a := f.Admin; a != nil {
+		if err := a.apply(cfg.Admin); err != nil {
+			return err
+		}
+	}
+
+	if st := f.Storage; st != nil {
+		if err := st.apply(cfg.Storage); err != nil {
+			return err
+		}
+	}
+
+	if l := f.Log; l != nil {
+		if err := l.apply(cfg.Log); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *authFile) applyMethod(opts *server.AuthOptions) error {
+	if a.Method == nil && opts.Password == "" {
+		return &Error{Key: "auth.method", Err: fmt.Errorf("not set, expected password, jwt or none")}
+	}
+	method := "password"
+	if a.Method != nil {
+		method = *a.Method
+	}
+
+	switch method {
+	case "password":
+		if opts.Password == "" {
+			return &Error{Key: "auth.password", Err: fmt.Errorf("required by method password, set auth.method to none to disable authentication")}
+		}
+		return nil
+	case "none":
+		if opts.Password != "" {
+			return &Error{Key: "auth.password", Err: fmt.Errorf("not used by method none")}
+		}
+		return nil
+	case "jwt":
+		if a.JWT == nil {
+			return &Error{Key: "auth.jwt", Err: fmt.Errorf("required by method jwt")}
+		}
+		jwtOpts := &server.JWTOptions{
+			Algorithms:    a.JWT.Algorithms,
+			Secret:        a.JWT.Secret,
+			PublicKeyFile: a.JWT.PublicKeyFile,
+			JWKSFile:      a.JWT.JWKSFile,
+			Issuer:        a.JWT.Issuer,
+			Audience:      a.JWT.Audience,
+			IdentityClaim: a.JWT.IdentityClaim,
+		}
+		if err := setDuration(&jwtOpts.Leeway, a.JWT.Leeway, "auth.jwt.leeway"); err != nil {
+			return err
+		}
+		authenticator, err := server.NewJWTAuthenticator(jwtOpts)
+		if err != nil {
+			return &Error{Key: "auth.jwt", Err: err}
+		}
+		opts.Authenticator = authenticator
+		return nil
+	}
+	return &Error{Key: "auth.method", Err: fmt.Errorf("unknown method %q, expected password, jwt or none", method)}
+}
+
+func (a *authFile) applyPermissions(opts *server.AuthOptions) error {
+	if a.DefaultPermissions != nil {
+		perms, err := a.DefaultPermissions.permissions("auth.default_permissions")
+		if err != nil {
+			return err
+		}
+		opts.DefaultPermissions = perms
+	}
+	if len(a.Permissions) == 0 {
+		return nil
+	}
+	opts.Permissions = make(map[string]*server.Permissions, len(a.Permissions))
+	for name, p := range a.Permissions {
+		if p == nil {
+			p = &permissionsFile{}
+		}
+		perms, err := p.permissions("auth.permissions." + name)
+		if err != nil {
+			return err
+		}
+		opts.Permissions[name] = perms
+	}
+	return nil
+}
+
+func (p *permissionsFile) permissions(key string) (*server.Permissions, error) {
+	for i, subject := range p.Publish {
+		if !server.ValidSubscribeSubject(subject) {
+			return nil, &Error{Key: fmt.Sprintf("%s.publish[%d]", key, i), Err: fmt.Errorf("invalid subject pattern %q", subject)}
+		}
+	}
+	for i, subject := range p.Subscribe {
+		if !server.ValidSubscribeSubject(subject) {
+			return nil, &Error{Key: fmt.Sprintf("%s.subscribe[%d]", key, i), Err: fmt.Errorf("invalid subject pattern %q", subject)}
+		}
+	}
+	return server.NewPermissions(p.Publish, p.Subscribe)
+}
+
+func (s *slowConsumerFile) apply(opts *server.SlowConsumerOptions) error {
+	if err := setNonNegative(&opts.MaxMessages, s.MaxMessages, "slow_consumer.max_messages"); err != nil {
+		return err
+	}
+	if err := setNonNegative(&opts.MaxBytes, s.MaxBytes, "slow_consumer.max_bytes"); err != nil {
+		return err
+	}
+	if s.Policy != nil {
+		policy, err := server.ParseSlowConsumerPolicy(*s.Policy)
+		if err != nil {
+			return &Error{Key: "slow_consumer.policy", Err: err}
+		}
+		opts.Policy = policy
+	}
+	if err := setDuration(&opts.BlockTimeout, s.BlockTimeout, "slow_consumer.block_timeout"); err != nil {
+		return err
+	}
+
+	opts.Topics = nil
+	for i, t := range s.Topics {
+		key := fmt.Sprintf("slow_consumer.topics[%d]", i)
+		if t == nil || !server.ValidSubscribeSubject(t.Subject) {
+			return &Error{Key: key + ".subject", Err: fmt.Errorf("invalid subject pattern")}
+		}
+		policy, err := server.ParseSlowConsumerPolicy(t.Policy)
+		if err != nil {
+			return &Error{Key: key + ".policy", Err: err}
+		}
+		opts.Topics = append(opts.Topics, &server.TopicPolicy{
+			Subject: t.Subject,
+			Policy:  policy,
+		})
+	}
+	return nil
+}
+
+func (a *adminFile) apply(opts *admin.Options) error {
+	if a.Addr != nil && *a.Addr != "" {
+		if err := setAddr(&opts.Addr, a.Addr, "admin.addr"); err != nil {
+			return err
+		}
+	}
+	if a.Token != nil {
+		opts.Token = *a.Token
+	}
+	if opts.Addr != "" && opts.Token == "" {
+		return &Error{Key: "admin.token", Err: fmt.Errorf("required to enable the admin api")}
+	}
+	return a.TLS.apply(&opts.TLS, "admin.tls")
+}
+
+func (s *storageFile) apply(opts *store.Options) error {
+	if s.Dir != nil {
+		opts.Dir = *s.Dir
+	}
+	if s.SegmentSize != nil {
+		if *s.SegmentSize <= 0 {
+			return &Error{Key: "storage.segment_size", Err: fmt.Errorf("must be positive, got %d", *s.SegmentSize)}
+		}
+		opts.SegmentSize = *s.SegmentSize
+	}
+	if s.MaxBytes != nil {
+		if *s.MaxBytes < 0 {
+			return &Error{Key: "storage.max_bytes", Err: fmt.Errorf("must not be negative, got %d", *s.MaxBytes)}
+		}
+		opts.MaxBytes = *s.MaxBytes
+	}
+	if err := setNonNegativeDuration(&opts.MaxAge, s.MaxAge, "storage.max_age"); err != nil {
+		return err
+	}
+	if s.Sync != nil {
+		policy, err := store.ParseSyncPolicy(*s.Sync)
+		if err != nil {
+			return &Error{Key: "storage.sync", Err: err}
+		}
+		opts.Sync = policy
+	}
+	return setDuration(&opts.SyncInterval, s.SyncInterval, "storage.sync_interval")
+}
+
+func (t *tlsFile) apply(dst **server.TLSOptions, key string) error {
+	if t == nil {
+		return nil
+	}
+	if t.CertFile == "" {
+		return &Error{Key: key + ".cert_file", Err: fmt.Errorf("required to enable tls")}
+	}
+	if t.KeyFile == "" {
+		return &Error{Key: key + ".key_file", Err: fmt.Errorf("required to enable tls")}
+	}
+	if t.Verify && t.CAFile == "" {
+		return &Error{Key: key + ".ca_file", Err: fmt.Errorf("required to verify client certificates")}
+	}
+	files := []struct{ key, name string }{
+		{"cert_file", t.CertFile},
+		{"key_file", t.KeyFile},
+		{"ca_file", t.CAFile},
+	}
+	for _, f := range files {
+		if f.name == "" {
+			continue
+		}
+		if _, err := os.Stat(f.name); err != nil {
+			return &Error{Key: key + "." + f.key, Err: err}
+		}
+	}
+	*dst = &server.TLSOptions{
+		CertFile: t.CertFile,
+		KeyFile:  t.KeyFile,
+		CAFile:   t.CAFile,
+		Verify:   t.Verify,
+	}
+	return nil
+}
+
+func (l *logFile) apply(opts *log.Options) error {
+	if l.Env != nil {
+		env, err := ParseEnvironment(*l.Env)
+		if err != nil {
+			return &Error{Key: "log.env", Err: err}
+		}
+		opts.Env = env
+	}
+	if l.Filename != nil {
+		if *l.Filename == "" {
+			return &Error{Key: "log.filename", Err: fmt.Errorf("must not be empty")}
+		}
+		opts.Filename = *l.Filename
+	}
+	if err := setNonNegative(&opts.MaxSize, l.MaxSize, "log.max_size"); err != nil {
+		return err
+	}
+	if err := setNonNegative(&opts.MaxAge, l.MaxAge, "log.max_age"); err != nil {
+		return err
+	}
+	if err := setNonNegative(&opts.MaxBackups, l.MaxBackups, "log.max_backups"); err != nil {
+		return err
+	}
+	if l.Compress != nil {
+		opts.Compress = *l.Compress
+	}
+	if l.LocalTime != nil {
+		opts.LocalTime = *l.LocalTime
+	}
+	if l.Level != nil {
+		if !log.ValidLevel(*l.Level) {
+			return &Error{Key: "log.level", Err: fmt.Errorf("unknown level %q", *l.Level)}
+		}
+		opts.Level = *l.Level
+	}
+	return nil
+}
+
+// ParseEnvironment converts the textual environment used in the
+// configuration file, "dev" or "prod".
+func ParseEnvironment(s string) (types.Environment, error) {
+	switch s {
+	case "dev":
+		return types.EnvDev, nil
+	case "prod":
+		return types.EnvProd, nil
+	}
+	return 0, fmt.Errorf("unknown environment %q, expected dev or prod", s)
+}
+
+func setDuration(dst *time.Duration, v *string, key string) error {
+	if v == nil {
+		return nil
+	}
+	d, err := time.ParseDuration(*v)
+	if err != nil {
+		return &Error{Key: key, Err: fmt.Errorf("invalid duration %q", *v)}
+	}
+	if d <= 0 {
+		return &Error{Key: key, Err: fmt.Errorf("must be positive, got %s", *v)}
+	}
+	*dst = d
+	return nil
+}
+
+func setNonNegativeDuration(dst *time.Duration, v *string, key string) error {
+	if v == nil {
+		return nil
+	}
+	d, err := time.ParseDuration(*v)
+	if err != nil {
+		return &Error{Key: key, Err: fmt.Errorf("invalid duration %q", *v)}
+	}
+	if d < 0 {
+		return &Error{Key: key, Err: fmt.Errorf("must not be negative, got %s", *v)}
+	}
+	*dst = d
+	return nil
+}
+
+func setAddr(dst *string, v *string, key string) error {
+	if v == nil {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(*v); err != nil {
+		return &Error{Key: key, Err: fmt.Errorf("invalid address %q, expected host:port", *v)}
+	}
+	*dst = *v
+	return nil
+}
+
+func setNonNegative(dst *int, v *int, key string) error {
+	if v == nil {
+		return nil
+	}
+	if *v < 0 {
+		return &Error{Key: key, Err: fmt.Errorf("must not be negative, got %d", *v)}
+	}
+	*dst = *v
+	return nil
+}
@@ -0,0 +1,139 @@
+package config
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/netraitcorp/netick/pkg/log"
+	"github.com/netraitcorp/netick/pkg/server"
+)
+
+func (c *Config) Clone() *Config {
+	l := *c.Log
+	m := *c.Metrics
+	a := *c.Admin
+	st := *c.Storage
+	return &Config{
+		Server:  c.Server.Clone(),
+		Log:     &l,
+		Metrics: &m,
+		Admin:   &a,
+		Storage: &st,
+	}
+}
+
+// Reload returns a copy of c carrying the values of n that can be changed on a
+// running server, along with the keys whose new value only takes effect after
+// a restart.
+func (c *Config) Reload(n *Config) (*Config, []string) {
+	r := c.Clone()
+
+	r.Server.PingInterval = n.Server.PingInterval
+	r.Server.MaxPingOutTimes = n.Server.MaxPingOutTimes
+	r.Server.MaxFrameSize = n.Server.MaxFrameSize
+	r.Server.Websocket.AppPing = n.Server.Websocket.AppPing
+	r.Server.Auth.Timeout = n.Server.Auth.Timeout
+	r.Server.Auth.Password = n.Server.Auth.Password
+	r.Server.Auth.Authenticator = n.Server.Auth.Authenticator
+	r.Server.Auth.Permissions = n.Server.Auth.Permissions
+	r.Server.Auth.DefaultPermissions = n.Server.Auth.DefaultPermissions
+	*r.Server.Shutdown = *n.Server.Shutdown
+	*r.Server.Compression = *n.Server.Compression
+	*r.Server.Batch = *n.Server.Batch
+	*r.Server.SlowConsumer = *n.Server.SlowConsumer
+	*r.Server.History = *n.Server.History
+	*r.Server.Retain = *n.Server.Retain
+	*r.Server.Durable = *n.Server.Durable
+	*r.Server.Session = *n.Server.Session
+	r.Log.Level = n.Log.Level
+
+	var restart []string
+	changed := func(key string, differ bool) {
+		if differ {
+			restart = append(restart, key)
+		}
+	}
+	changed("websocket.addr", c.Server.Websocket.Addr != n.Server.Websocket.Addr)
+	changed("websocket.read_timeout", c.Server.Websocket.ReadTimeout != n.Server.Websocket.ReadTimeout)
+	changed("websocket.write_timeout", c.Server.Websocket.WriteTimeout != n.Server.Websocket.WriteTimeout)
+	changed("websocket.tls", !reflect.DeepEqual(c.Server.Websocket.TLS, n.Server.Websocket.TLS))
+	changed("tcp.addr", c.Server.TCP.Addr != n.Server.TCP.Addr)
+	changed("tcp.tls", !reflect.DeepEqual(c.Server.TCP.TLS, n.Server.TCP.TLS))
+	changed("log.env", c.Log.Env != n.Log.Env)
+	changed("log.filename", c.Log.Filename != n.Log.Filename)
+	changed("log.max_size", c.Log.MaxSize != n.Log.MaxSize)
+	changed("log.max_age", c.Log.MaxAge != n.Log.MaxAge)
+	changed("log.max_backups", c.Log.MaxBackups != n.Log.MaxBackups)
+	changed("log.compress", c.Log.Compress != n.Log.Compress)
+	changed("log.local_time", c.Log.LocalTime != n.Log.LocalTime)
+	changed("metrics.addr", c.Metrics.Addr != n.Metrics.Addr)
+	changed("metrics.path", c.Metrics.Path != n.Metrics.Path)
+	changed("admin.addr", c.Admin.Addr != n.Admin.Addr)
+	changed("admin.token", c.Admin.Token != n.Admin.Token)
+	changed("admin.tls", !reflect.DeepEqual(c.Admin.TLS, n.Admin.TLS))
+	changed("storage.dir", c.Storage.Dir != n.Storage.Dir)
+	changed("storage.segment_size", c.Storage.SegmentSize != n.Storage.SegmentSize)
+	changed("storage.max_bytes", c.Storage.MaxBytes != n.Storage.MaxBytes)
+	changed("storage.max_age", c.Storage.MaxAge != n.Storage.MaxAge)
+	changed("storage.sync", c.Storage.Sync != n.Storage.Sync)
+	changed("storage.sync_interval", c.Storage.SyncInterval != n.Storage.SyncInterval)
+
+	return r, restart
+}
+
+// Reloader re-reads the configuration file and pushes the safely changeable
+// values to the running servers, the shared server state and the logger.
+type Reloader struct {
+	mu       sync.Mutex
+	filename string
+	cfg      *Config
+	override func(*Config)
+	servers  []server.Server
+}
+
+// NewReloader creates a Reloader for the configuration cfg the servers were
+// started with. override, if not nil, is applied to every freshly loaded
+// configuration, e.g. to keep command line flags in precedence.
+func NewReloader(filename string, cfg *Config, override func(*Config), servers ...server.Server) *Reloader {
+	return &Reloader{
+		filename: filename,
+		cfg:      cfg,
+		override: override,
+		servers:  servers,
+	}
+}
+
+// Reload applies the configuration file and returns the keys that changed but
+// require a restart. Nothing is applied when the file is invalid.
+func (r *Reloader) Reload() ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n, err := Load(r.filename)
+	if err != nil {
+		return nil, err
+	}
+	if r.override != nil {
+		r.override(n)
+	}
+
+	cfg, restart := r.cfg.Reload(n)
+	for _, srv := range r.servers {
+		srv.Reload(cfg.Server)
+	}
+	server.Configure(cfg.Server)
+	if err := log.SetLevel(cfg.Log.Level); err != nil {
+		return nil, err
+	}
+	r.cfg = cfg
+
+	return restart, nil
+}
+
+// Config returns the configuration currently in effect.
+func (r *Reloader) Config() *Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.cfg
+}
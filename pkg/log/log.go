@@ -23,9 +23,10 @@ type Options struct {
 }
 
 var (
-	once       sync.Once
-	logger     *zap.SugaredLogger
-	loggerOpts *Options
+	once        sync.Once
+	logger      *zap.SugaredLogger
+	loggerOpts  *Options
+	atomicLevel = zap.NewAtomicLevel()
 )
 
 var level = map[string]zapcore.Level{
@@ -38,6 +39,11 @@ var level = map[string]zapcore.Level{
 	"fatal":  zapcore.FatalLevel,
 }
 
+func ValidLevel(l string) bool {
+	_, ok := level[l]
+	return ok
+}
+
 func NewOptions() *Options {
 	return &Options{
 		Env:        types.EnvProd,
@@ -65,7 +71,6 @@ func Init(opts *Options) {
 		if l, ok := level[opts.Level]; ok {
 			lvl = l
 		}
-		atomicLevel := zap.NewAtomicLevel()
 		atomicLevel.SetLevel(lvl)
 		encoderConfig := zap.NewProductionEncoderConfig()
 		encoderConfig.EncodeTime = zapcore.RFC3339TimeEncoder
@@ -95,6 +100,22 @@ func Init(opts *Options) {
 	})
 }
 
+// SetLevel changes the level of the running logger, it is safe to call
+// concurrently with logging.
+func SetLevel(l string) error {
+	lvl, ok := level[l]
+	if !ok {
+		return fmt.Errorf("log.SetLevel: unknown level %q", l)
+	}
+	atomicLevel.SetLevel(lvl)
+	return nil
+}
+
+// Sync flushes any buffered log entries.
+func Sync() error {
+	return logger.Sync()
+}
+
 func Debug(template string, args ...interface{}) {
 	logger.Debugf(template, args...)
 }
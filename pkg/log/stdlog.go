@@ -9,3 +9,8 @@ func StdInfo(format string, args ...interface{}) {
 	format = fmt.Sprintf("[INFO] %s\n", format)
 	std.Printf(format, args...)
 }
+
+func StdError(format string, args ...interface{}) {
+	format = fmt.Sprintf("[ERROR] %s\n", format)
+	std.Printf(format, args...)
+}
@@ -0,0 +1,118 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "netick"
+
+// Transport labels.
+const (
+	TransportWebsocket = "websocket"
+	TransportTCP       = "tcp"
+)
+
+var (
+	Connections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "connections",
+		Help:      "Established client connections by transport.",
+	}, []string{"transport"})
+
+	Auths = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_total",
+		Help:      "Authentication attempts by result, success, failure or resumed.",
+	}, []string{"result"})
+
+	Subscriptions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "subscriptions",
+		Help:      "Subscribed connections by topic.",
+	}, []string{"topic"})
+
+	Topics = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "topic_goroutines",
+		Help:      "Running topic broadcast goroutines.",
+	})
+
+	MessagesIn = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_in_total",
+		Help:      "Messages published by clients.",
+	})
+
+	BytesIn = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bytes_in_total",
+		Help:      "Payload bytes of the messages published by clients.",
+	})
+
+	MessagesOut = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_out_total",
+		Help:      "Messages queued for delivery to subscribers.",
+	})
+
+	BytesOut = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bytes_out_total",
+		Help:      "Payload bytes of the messages queued for delivery to subscribers.",
+	})
+
+	Dropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dropped_frames_total",
+		Help:      "Frames dropped from full send queues and topic queues.",
+	})
+
+	DroppedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dropped_bytes_total",
+		Help:      "Bytes of the frames dropped from full send queues and topic queues.",
+	})
+
+	BlockedWrites = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "blocked_writes_total",
+		Help:      "Writes that waited for room in a full send queue under the block policy.",
+	})
+
+	SlowConsumerDisconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "slow_consumer_disconnects_total",
+		Help:      "Connections closed for being slow consumers.",
+	})
+
+	PingRTT = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "ping_rtt_seconds",
+		Help:      "Round trip time measured by pings, by transport.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"transport"})
+)
+
+// Registry holds the netick metrics along with the Go runtime and process
+// collectors.
+var Registry = prometheus.NewRegistry()
+
+func init() {
+	Registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		Connections,
+		Auths,
+		Subscriptions,
+		Topics,
+		MessagesIn,
+		BytesIn,
+		MessagesOut,
+		BytesOut,
+		Dropped,
+		DroppedBytes,
+		BlockedWrites,
+		SlowConsumerDisconnects,
+		PingRTT,
+	)
+}
@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type Options struct {
+	// Addr of the HTTP listener, empty disables it.
+	Addr string
+	Path string
+}
+
+func NewOptions() *Options {
+	return &Options{
+		Addr: "",
+		Path: "/metrics",
+	}
+}
+
+// Server exposes Registry in the Prometheus text format.
+type Server struct {
+	opts    *Options
+	httpSrv *http.Server
+	mu      sync.Mutex
+}
+
+func NewServer(opts *Options) *Server {
+	return &Server{
+		opts: opts,
+	}
+}
+
+func (srv *Server) ListenAndServe() error {
+	mux := http.NewServeMux()
+	mux.Handle(srv.opts.Path, promhttp.HandlerFor(Registry, promhttp.HandlerOpts{}))
+
+	httpSrv := &http.Server{
+		Addr:    srv.opts.Addr,
+		Handler: mux,
+	}
+
+	srv.mu.Lock()
+	srv.httpSrv = httpSrv
+	srv.mu.Unlock()
+
+	if err := httpSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.mu.Lock()
+	httpSrv := srv.httpSrv
+	srv.mu.Unlock()
+
+	if httpSrv == nil {
+		return nil
+	}
+	return httpSrv.Shutdown(ctx)
+}
@@ -1,91 +1,261 @@
 package server
 
 import (
+	"sort"
 	"sync"
+	"time"
+
+	"github.com/netraitcorp/netick/pb"
+	"github.com/netraitcorp/netick/pkg/log"
+	"github.com/netraitcorp/netick/pkg/metrics"
+	"github.com/netraitcorp/netick/pkg/types"
 )
 
+// Account is the session of an authenticated client. It outlives its
+// connection while suspended, a resumed session is reattached to the new
+// connection under the same ID.
 type Account struct {
-	conn Conn
+	id          string
+	conn        Conn
+	identity    *Identity
+	perms       *Permissions
+	topics      sync.Map
+	durables    sync.Map
+	connectedAt time.Time
+	mu          sync.RWMutex
+
+	// sendMu orders the messages delivered to the connection with the ones
+	// buffered while the session is suspended.
+	sendMu    sync.Mutex
+	suspended bool
+	buffer    []*pb.Message
+	bufSize   int
+
+	// token and expiry are guarded by the sessions mutex.
+	token  string
+	expiry *time.Timer
 }
 
 func (acc *Account) ID() string {
-	return acc.conn.ConnID()
+	return acc.id
 }
 
-func NewAccount(conn Conn) *Account {
-	return &Account{
-		conn: conn,
-	}
+// Conn returns the connection of the session, the lost one while it is
+// suspended.
+func (acc *Account) Conn() Conn {
+	acc.mu.RLock()
+	defer acc.mu.RUnlock()
+
+	return acc.conn
 }
 
-type Accounts struct {
-	accs sync.Map
-	mu   sync.Mutex
+func (acc *Account) Identity() *Identity {
+	acc.mu.RLock()
+	defer acc.mu.RUnlock()
+
+	return acc.identity
 }
 
-func (as *Accounts) AddAccount(acc *Account) {
-	as.accs.Store(acc.ID(), acc)
+// Permissions returns the permissions resolved at authorization.
+func (acc *Account) Permissions() *Permissions {
+	acc.mu.RLock()
+	defer acc.mu.RUnlock()
+
+	return acc.perms
 }
 
-func (as *Accounts) RemoveAccount(id string) {
-	as.accs.Delete(id)
+func (acc *Account) ConnectedAt() time.Time {
+	return acc.connectedAt
 }
 
-func NewAccounts() *Accounts {
-	as := &Accounts{}
-	return as
+// Subscriptions returns the names the account is subscribed to, sorted.
+func (acc *Account) Subscriptions() []string {
+	var names []string
+	acc.topics.Range(func(key, _ interface{}) bool {
+		names = append(names, key.(string))
+		return true
+	})
+	sort.Strings(names)
+	return names
 }
 
-var accounts = NewAccounts()
+func (acc *Account) setIdentity(identity *Identity, perms *Permissions) {
+	acc.mu.Lock()
+	defer acc.mu.Unlock()
 
-/*
+	acc.identity = identity
+	acc.perms = perms
+}
 
-func (accs *Accounts) CreateAccount(conn Conn) {
-	accs.Store(conn.ConnID(), &Account{
-		conn: conn,
-	})
+// Suspended tells whether the session lost its connection and waits to be
+// resumed.
+func (acc *Account) Suspended() bool {
+	acc.sendMu.Lock()
+	defer acc.sendMu.Unlock()
+
+	return acc.suspended
 }
 
-func (accs *Accounts) Subscribe(id int64, topicName string) error {
-	account, ok := accs.Load(id)
-	if !ok {
-		return ErrAccountNotExists
+// deliver sends a message to the connection, frames caches its encoding and
+// may be nil, deadline bounds the wait of the Block policy and may be zero.
+// The message is buffered while the session is suspended.
+func (acc *Account) deliver(msg *pb.Message, frames *frameCache, deadline time.Time) error {
+	acc.sendMu.Lock()
+	defer acc.sendMu.Unlock()
+
+	if acc.suspended {
+		acc.keep(msg)
+		return nil
 	}
-	ac := account.(*Account)
-	topic := topics.GetTopicForce(topicName)
+	return acc.send(msg, frames, deadline)
+}
 
-	topic.Subscribe(ac)
-	ac.topics.Store(topicName, topic)
+func (acc *Account) send(msg *pb.Message, frames *frameCache, deadline time.Time) error {
+	var (
+		data []byte
+		err  error
+	)
+	if frames != nil {
+		data, err = frames.frame(acc.conn.Codec())
+	} else {
+		data, err = acc.conn.Codec().Marshal(types.OpMessage, msg)
+	}
+	if err != nil {
+		return err
+	}
+	policy := acc.conn.Server().Options().SlowConsumer.policy(msg.Name)
+	if err := acc.conn.Send(data, policy, deadline); err != nil {
+		return err
+	}
+	metrics.MessagesOut.Inc()
+	metrics.BytesOut.Add(float64(len(msg.Data)))
 	return nil
 }
 
-func (accs *Accounts) UnSubscribe(id int64, topicName string) error {
-	account, ok := accs.Load(id)
-	if !ok {
-		return ErrAccountNotExists
+// keep buffers a message for a suspended session, the oldest are dropped
+// beyond the session bounds.
+func (acc *Account) keep(msg *pb.Message) {
+	acc.buffer = append(acc.buffer, msg)
+	acc.bufSize += len(msg.Data)
+
+	opts := sessions.options()
+	n, size := 0, 0
+	for len(acc.buffer)-n > 1 && ((opts.MaxBuffered > 0 && len(acc.buffer)-n > opts.MaxBuffered) ||
+		(opts.MaxBufferedBytes > 0 && acc.bufSize-size > opts.MaxBufferedBytes)) {
+		size += len(acc.buffer[n].Data)
+		acc.buffer[n] = nil
+		n++
 	}
-	ac := account.(*Account)
-	topic, ok := ac.topics.Load(topicName)
-	if !ok {
-		return ErrAccountNotSubscribe
+	if n > 0 {
+		acc.buffer = acc.buffer[n:]
+		acc.bufSize -= size
+		metrics.Dropped.Add(float64(n))
+		metrics.DroppedBytes.Add(float64(size))
 	}
+}
 
-	topic.(*Topic).UnSubscribe(id)
-	ac.topics.Delete(topicName)
+// suspend buffers the messages until the session is resumed.
+func (acc *Account) suspend() {
+	acc.sendMu.Lock()
+	defer acc.sendMu.Unlock()
 
-	return nil
+	acc.suspended = true
+}
+
+// reattach replaces the connection of the session and returns the previous
+// one. Messages are buffered until resume flushes them.
+func (acc *Account) reattach(conn Conn) Conn {
+	acc.sendMu.Lock()
+	defer acc.sendMu.Unlock()
+
+	acc.mu.Lock()
+	old := acc.conn
+	acc.conn = conn
+	acc.mu.Unlock()
+
+	acc.suspended = true
+	return old
+}
+
+// resume writes unsent, the frames the previous connection did not get to
+// send, followed by the buffered messages and delivers live messages again.
+// unsent is dropped when the connections use different codecs. The backlog
+// shares a single Block deadline.
+func (acc *Account) resume(unsent [][]byte, codec Codec) {
+	acc.sendMu.Lock()
+	defer acc.sendMu.Unlock()
+
+	if len(unsent) > 0 && codec != acc.conn.Codec() {
+		log.Warn("Account.resume: codec changed, dropping %d unsent frames, cid: %s", len(unsent), acc.id)
+		unsent = nil
+	}
+	opts := acc.conn.Server().Options().SlowConsumer
+	deadline := backlogDeadline(opts)
+	for _, data := range unsent {
+		if err := acc.conn.Send(data, opts.Policy, deadline); err != nil {
+			log.Warn("Account.resume: write failed, cid: %s, err: %s", acc.id, err.Error())
+		}
+	}
+	for _, msg := range acc.buffer {
+		if err := acc.send(msg, nil, deadline); err != nil {
+			log.Warn("Account.resume: write failed, cid: %s, err: %s", acc.id, err.Error())
+		}
+	}
+	acc.buffer = nil
+	acc.bufSize = 0
+	acc.suspended = false
+}
+
+func NewAccount(conn Conn) *Account {
+	return &Account{
+		id:          conn.ConnID(),
+		conn:        conn,
+		connectedAt: time.Now(),
+	}
+}
+
+// closeAccount drops the subscriptions of acc and forgets it.
+func closeAccount(acc *Account) {
+	subscribe.UnSubscribeAll(acc)
+	durables.DetachAll(acc)
+	accounts.RemoveAccount(acc.ID())
+
+	acc.sendMu.Lock()
+	acc.buffer = nil
+	acc.bufSize = 0
+	acc.sendMu.Unlock()
+}
+
+type Accounts struct {
+	accs sync.Map
+	mu   sync.Mutex
+}
+
+func (as *Accounts) AddAccount(acc *Account) {
+	as.accs.Store(acc.ID(), acc)
+}
+
+func (as *Accounts) RemoveAccount(id string) {
+	as.accs.Delete(id)
 }
 
-func (accs *Accounts) RemoveAccount(id int64) {
-	acc, ok := accs.Load(id)
+func (as *Accounts) Account(id string) (*Account, bool) {
+	acc, ok := as.accs.Load(id)
 	if !ok {
-		return
+		return nil, false
 	}
-	acc.(*Account).topics.Range(func(_, value interface{}) bool {
-		value.(*Topic).UnSubscribe(id)
-		return true
+	return acc.(*Account), true
+}
+
+func (as *Accounts) Range(f func(acc *Account) bool) {
+	as.accs.Range(func(_, value interface{}) bool {
+		return f(value.(*Account))
 	})
-	accs.Delete(id)
 }
 
-*/
+func NewAccounts() *Accounts {
+	as := &Accounts{}
+	return as
+}
+
+var accounts = NewAccounts()
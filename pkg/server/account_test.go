@@ -0,0 +1,48 @@
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/netraitcorp/netick/pb"
+)
+
+func TestAccountResumeBacklog(t *testing.T) {
+	opts := blockOptions()
+	acc, conn := newTestAccount(opts)
+
+	var (
+		mu        sync.Mutex
+		deadlines []time.Time
+	)
+	conn.onSend = blockUntil(&mu, &deadlines)
+
+	acc.suspend()
+	const buffered = 10
+	for i := 0; i < buffered; i++ {
+		if err := acc.deliver(&pb.Message{Name: "resume.backlog", Seq: uint64(i + 1)}, nil, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := time.Now()
+	acc.resume(nil, packet)
+	if elapsed := time.Since(start); elapsed > 4*opts.SlowConsumer.BlockTimeout {
+		t.Fatalf("backlog of %d messages took %s, want a single block timeout", buffered, elapsed)
+	}
+	if acc.Suspended() {
+		t.Fatal("account still suspended")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(deadlines) != buffered {
+		t.Fatalf("sent %d messages, want %d", len(deadlines), buffered)
+	}
+	for _, dl := range deadlines {
+		if dl.IsZero() || !dl.Equal(deadlines[0]) {
+			t.Fatalf("deadlines %v, want a single one for the backlog", deadlines)
+		}
+	}
+}
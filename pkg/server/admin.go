@@ -0,0 +1,182 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/netraitcorp/netick/pb"
+	"github.com/netraitcorp/netick/pkg/log"
+	"github.com/netraitcorp/netick/pkg/metrics"
+	"github.com/netraitcorp/netick/pkg/types"
+)
+
+// ConnInfo describes a live connection for the admin API.
+type ConnInfo struct {
+	ConnID        string    `json:"conn_id"`
+	RemoteAddr    string    `json:"remote_addr"`
+	Transport     string    `json:"transport"`
+	Codec         string    `json:"codec"`
+	Identity      string    `json:"identity,omitempty"`
+	ConnectedAt   time.Time `json:"connected_at"`
+	Suspended     bool      `json:"suspended,omitempty"`
+	Queued        int       `json:"queued"`
+	Dropped       uint64    `json:"dropped"`
+	DroppedBytes  uint64    `json:"dropped_bytes"`
+	Blocked       uint64    `json:"blocked"`
+	RTT           string    `json:"rtt"`
+	Subscriptions []string  `json:"subscriptions"`
+}
+
+// TopicInfo describes a topic for the admin API.
+type TopicInfo struct {
+	Name        string `json:"name"`
+	Subscribers int    `json:"subscribers"`
+}
+
+var ErrConnNotFound = fmt.Errorf("connection not found")
+
+func connInfo(acc *Account) *ConnInfo {
+	conn := acc.Conn()
+	slow := conn.SlowConsumer()
+	info := &ConnInfo{
+		ConnID:        acc.ID(),
+		RemoteAddr:    conn.RemoteAddr().String(),
+		Transport:     transport(conn),
+		Codec:         conn.Codec().Name(),
+		ConnectedAt:   acc.ConnectedAt(),
+		Suspended:     acc.Suspended(),
+		Queued:        conn.Buffered(),
+		Dropped:       slow.Dropped,
+		DroppedBytes:  slow.DroppedBytes,
+		Blocked:       slow.Blocked,
+		RTT:           conn.RTT().String(),
+		Subscriptions: acc.Subscriptions(),
+	}
+	if identity := acc.Identity(); identity != nil {
+		info.Identity = identity.Name
+	}
+	return info
+}
+
+func transport(c Conn) string {
+	switch c.(type) {
+	case *WebsocketConn:
+		return metrics.TransportWebsocket
+	case *TCPConn:
+		return metrics.TransportTCP
+	}
+	return "unknown"
+}
+
+// ListConns returns the live connections, oldest first.
+func ListConns() []*ConnInfo {
+	conns := make([]*ConnInfo, 0)
+	accounts.Range(func(acc *Account) bool {
+		conns = append(conns, connInfo(acc))
+		return true
+	})
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].ConnectedAt.Before(conns[j].ConnectedAt)
+	})
+	return conns
+}
+
+func GetConn(cid string) (*ConnInfo, error) {
+	acc, ok := accounts.Account(cid)
+	if !ok {
+		return nil, ErrConnNotFound
+	}
+	return connInfo(acc), nil
+}
+
+// ListTopics returns the topics, sorted by name.
+func ListTopics() []*TopicInfo {
+	ts := make([]*TopicInfo, 0)
+	subscribe.Range(func(topic *Topic) bool {
+		ts = append(ts, &TopicInfo{
+			Name:        topic.Name(),
+			Subscribers: topic.Subscribers(),
+		})
+		return true
+	})
+	sort.Slice(ts, func(i, j int) bool {
+		return ts[i].Name < ts[j].Name
+	})
+	return ts
+}
+
+// Kick closes the connection cid once the client received a GoAway frame
+// carrying reason.
+func Kick(cid string, reason string) error {
+	acc, ok := accounts.Account(cid)
+	if !ok {
+		return ErrConnNotFound
+	}
+
+	// a kicked session is not resumable
+	sessions.discard(acc)
+	if acc.Suspended() {
+		log.Info("Kick: closed suspended session, cid: %s, reason: %s", cid, reason)
+		return nil
+	}
+
+	conn := acc.Conn()
+	data, err := conn.Codec().Marshal(types.OpGoAway, &pb.GoAway{
+		Reason: reason,
+	})
+	if err == nil {
+		err = conn.Write(data)
+	}
+	if err != nil {
+		log.Warn("Kick: write go away failed, cid: %s, err: %s", cid, err.Error())
+	}
+	go flushAndClose(conn)
+
+	log.Info("Kick: cid: %s, reason: %s", cid, reason)
+	return nil
+}
+
+// ForceUnsubscribe detaches the connection cid from the topic name, the
+// client is notified with an UnsubscribeResp. It reports whether the
+// connection was subscribed.
+func ForceUnsubscribe(cid string, name string) (bool, error) {
+	acc, ok := accounts.Account(cid)
+	if !ok {
+		return false, ErrConnNotFound
+	}
+	if !subscribe.UnSubscribe(name, acc) {
+		return false, nil
+	}
+
+	conn := acc.Conn()
+	data, err := conn.Codec().Marshal(types.OpUnsubscribeRet, &pb.UnsubscribeResp{
+		Name: name,
+	})
+	if err == nil {
+		err = conn.Write(data)
+	}
+	if err != nil {
+		log.Warn("ForceUnsubscribe: write unsubscribe failed, cid: %s, err: %s", cid, err.Error())
+	}
+
+	log.Info("ForceUnsubscribe: topic: %s, cid: %s", name, cid)
+	return true, nil
+}
+
+// Publish delivers a message to the subscribers of subject as if a client
+// had published it, except that it does not wait for slow subscribers under
+// the Block policy.
+func Publish(subject string, data []byte, retain bool) error {
+	if !ValidPublishSubject(subject) {
+		return fmt.Errorf("invalid subject %q", subject)
+	}
+	subscribe.Publish(subject, data, retain, time.Time{})
+	return nil
+}
+
+// ClearRetained drops the retained value of subject and reports whether
+// there was one.
+func ClearRetained(subject string) bool {
+	return subscribe.ClearRetained(subject)
+}
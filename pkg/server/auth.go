@@ -0,0 +1,48 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/netraitcorp/netick/pb"
+	"github.com/netraitcorp/netick/pkg/util"
+)
+
+// Identity is the authenticated user behind a connection.
+type Identity struct {
+	Name string
+	// Permissions granted by the authenticator itself, e.g. from token
+	// claims. When nil the permissions configured for Name apply.
+	Permissions *Permissions
+	// Stable is set when Name outlives the connection, e.g. the subject of
+	// a token or a client certificate. Durable subscriptions require it.
+	Stable bool
+}
+
+// Authenticator validates the AuthReq sent by a client and resolves the
+// identity of the connection.
+type Authenticator interface {
+	Authenticate(conn Conn, req *pb.AuthReq) (*Identity, error)
+}
+
+// PasswordAuthenticator checks the SHA-1 digest of a password shared by all
+// clients, an empty password accepts everyone. The identity is the subject
+// of the client certificate when there is one, the connection ID otherwise.
+type PasswordAuthenticator struct {
+	Password string
+}
+
+func (a *PasswordAuthenticator) Authenticate(conn Conn, req *pb.AuthReq) (*Identity, error) {
+	if a.Password != "" {
+		if req.GetPassword() == "" {
+			return nil, fmt.Errorf("PasswordAuthenticator.Authenticate: password empty, cid: %s", conn.ConnID())
+		}
+		if req.GetPassword() != util.Sha1(a.Password) {
+			return nil, fmt.Errorf("PasswordAuthenticator.Authenticate: password incorrect, cid: %s", conn.ConnID())
+		}
+	}
+
+	if name := certIdentity(conn.TLSState()); name != "" {
+		return &Identity{Name: name, Stable: true}, nil
+	}
+	return &Identity{Name: conn.ConnID()}, nil
+}
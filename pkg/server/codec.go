@@ -0,0 +1,155 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/netraitcorp/netick/pb"
+	"github.com/netraitcorp/netick/pkg/types"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec names, also used as websocket subprotocols to pick the codec of a
+// connection.
+const (
+	CodecProto = "netick.proto"
+	CodecJSON  = "netick.json"
+)
+
+// Codec encodes the frames exchanged with a client, each connection has one.
+type Codec interface {
+	Name() string
+	Marshal(code types.OpCode, payload interface{}) ([]byte, error)
+	Unmarshal(data []byte) (types.OpCode, interface{}, error)
+}
+
+// JSONPacket is the JSON codec, a frame is {"op": <opcode>, "data": <msg>}
+// where msg follows the proto3 JSON mapping of the message in packet.proto,
+// unknown fields are ignored. A batch is the exception, its data is
+// {"frames": [<frame>, ...]} with the frames as JSON objects.
+type JSONPacket struct{}
+
+type jsonFrame struct {
+	Op   types.OpCode    `json:"op"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+type jsonBatch struct {
+	Frames []json.RawMessage `json:"frames"`
+}
+
+var jsonUnmarshal = protojson.UnmarshalOptions{DiscardUnknown: true}
+
+func (*JSONPacket) Name() string {
+	return CodecJSON
+}
+
+func (*JSONPacket) Marshal(code types.OpCode, payload interface{}) ([]byte, error) {
+	if batch, ok := payload.(*pb.Batch); ok {
+		return marshalJSONBatch(code, batch)
+	}
+	pack, ok := payload.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("JSONPacket.Marshal: payload type is not proto.Message")
+	}
+	data, err := protojson.Marshal(pack)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&jsonFrame{
+		Op:   code,
+		Data: data,
+	})
+}
+
+func (*JSONPacket) Unmarshal(payload []byte) (types.OpCode, interface{}, error) {
+	var frame jsonFrame
+	if err := json.Unmarshal(payload, &frame); err != nil {
+		return types.OpUnknown, nil, fmt.Errorf("JSONPacket.Unmarshal failed: %s", err.Error())
+	}
+
+	newMsg, ok := requestTypes[frame.Op]
+	if !ok {
+		return frame.Op, nil, nil
+	}
+	unpack := newMsg()
+	if len(frame.Data) == 0 {
+		return frame.Op, unpack, nil
+	}
+	if batch, ok := unpack.(*pb.Batch); ok {
+		return frame.Op, batch, unmarshalJSONBatch(frame.Data, batch)
+	}
+	err := jsonUnmarshal.Unmarshal(frame.Data, unpack)
+	return frame.Op, unpack, err
+}
+
+func marshalJSONBatch(code types.OpCode, batch *pb.Batch) ([]byte, error) {
+	frames := make([]json.RawMessage, len(batch.Frames))
+	for i, f := range batch.Frames {
+		frames[i] = f
+	}
+	data, err := json.Marshal(&jsonBatch{Frames: frames})
+	if err != nil {
+		return nil, fmt.Errorf("JSONPacket.Marshal: batch: %s", err.Error())
+	}
+	return json.Marshal(&jsonFrame{
+		Op:   code,
+		Data: data,
+	})
+}
+
+func unmarshalJSONBatch(data []byte, batch *pb.Batch) error {
+	var b jsonBatch
+	if err := json.Unmarshal(data, &b); err != nil {
+		return fmt.Errorf("JSONPacket.Unmarshal: batch: %s", err.Error())
+	}
+	for _, f := range b.Frames {
+		batch.Frames = append(batch.Frames, f)
+	}
+	return nil
+}
+
+var jsonPacket = &JSONPacket{}
+
+var codecs = map[string]Codec{
+	CodecProto: packet,
+	CodecJSON:  jsonPacket,
+}
+
+// codecByName returns the codec negotiated with the client, protobuf when
+// none was.
+func codecByName(name string) Codec {
+	if c, ok := codecs[name]; ok {
+		return c
+	}
+	return packet
+}
+
+// frameCache encodes a message once per codec when it is sent to many
+// connections.
+type frameCache struct {
+	code    types.OpCode
+	payload interface{}
+	frames  map[Codec][]byte
+}
+
+func newFrameCache(code types.OpCode, payload interface{}) *frameCache {
+	return &frameCache{
+		code:    code,
+		payload: payload,
+		frames:  make(map[Codec][]byte, len(codecs)),
+	}
+}
+
+func (fc *frameCache) frame(codec Codec) ([]byte, error) {
+	if data, ok := fc.frames[codec]; ok {
+		return data, nil
+	}
+	data, err := codec.Marshal(fc.code, fc.payload)
+	if err != nil {
+		return nil, err
+	}
+	fc.frames[codec] = data
+	return data, nil
+}
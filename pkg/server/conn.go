@@ -1,8 +1,13 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"net"
 	"time"
+
+	"github.com/netraitcorp/netick/pb"
+	"github.com/netraitcorp/netick/pkg/types"
 )
 
 const (
@@ -16,18 +21,99 @@ type Conn interface {
 
 	RemoteAddr() net.Addr
 
+	// TLSState returns the state of the TLS session, nil for plaintext
+	// connections.
+	TLSState() *tls.ConnectionState
+
 	Accept()
 
 	Close() error
 
 	Closed() bool
 
+	// Codec returns the codec frames written to the connection must be
+	// encoded with.
+	Codec() Codec
+
+	// Write queues data under the slow consumer policy of the server.
 	Write(data []byte) error
 
+	// Send queues data under the slow consumer policy given, deadline bounds
+	// the wait of the Block policy, zero waits up to the block timeout.
+	Send(data []byte, policy SlowConsumerPolicy, deadline time.Time) error
+
+	// Buffered returns the number of frames queued by Write and not yet
+	// written to the network.
+	Buffered() int
+
+	// SlowConsumer returns the counters of the frames lost to, or delayed by,
+	// the slow consumer policy.
+	SlowConsumer() SlowConsumerStats
+
+	// Unsent removes and returns the frames queued by Write that were not
+	// taken by the write loop, e.g. after the connection was lost.
+	Unsent() [][]byte
+
+	// Heartbeat records a sign of life from the peer along with the round
+	// trip time measured by a ping, zero when it was not measured.
+	Heartbeat(rtt time.Duration)
+
+	// RTT returns the last measured round trip time.
+	RTT() time.Duration
+
 	Server() Server
 }
 
-type pingt struct {
-	lastp time.Time
-	timer *time.Timer
+// coalesce takes the frames queued on q, until opts MaxSize bytes are
+// gathered or no frame is queued within opts Linger.
+func coalesce(ctx context.Context, q *sendQueue, opts *BatchOptions) [][]byte {
+	frames := q.take(opts.MaxSize)
+	if len(frames) == 0 || opts.MaxSize <= 0 || opts.Linger <= 0 {
+		return frames
+	}
+
+	timer := time.NewTimer(opts.Linger)
+	defer timer.Stop()
+
+	size := frameSize(frames)
+	for size < opts.MaxSize {
+		select {
+		case <-q.ready:
+			more := q.take(opts.MaxSize - size)
+			frames = append(frames, more...)
+			size += frameSize(more)
+		case <-timer.C:
+			return frames
+		case <-ctx.Done():
+			return frames
+		}
+	}
+	return frames
+}
+
+// batchFrame wraps frames into a single batch frame.
+func batchFrame(codec Codec, frames [][]byte) ([]byte, error) {
+	return codec.Marshal(types.OpBatch, &pb.Batch{
+		Frames: frames,
+	})
+}
+
+// frameSize returns the bytes held by frames.
+func frameSize(frames [][]byte) int {
+	n := 0
+	for _, f := range frames {
+		n += len(f)
+	}
+	return n
+}
+
+// flushAndClose gives the write loop up to writeWait to send the frames
+// queued so far, such as the error frame explaining the disconnect, before
+// closing the connection.
+func flushAndClose(c Conn) {
+	deadline := time.Now().Add(writeWait)
+	for c.Buffered() > 0 && !c.Closed() && time.Now().Before(deadline) {
+		time.Sleep(drainPollInterval)
+	}
+	_ = c.Close()
 }
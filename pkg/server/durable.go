@@ -0,0 +1,255 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/netraitcorp/netick/pb"
+	"github.com/netraitcorp/netick/pkg/log"
+)
+
+// Durable is a named subscription of an identity that outlives its
+// connections. The messages are kept until acknowledged and delivered again
+// when the client subscribes with the same name after reconnecting. Durables
+// live in memory, they do not survive a restart.
+type Durable struct {
+	identity string
+	name     string
+	subject  string
+
+	mu      sync.Mutex
+	acc     *Account
+	acked   uint64
+	pending []*pb.Message
+	size    int
+	dropped uint64
+	expiry  *time.Timer
+	stopped bool
+}
+
+func NewDurable(identity, name, subject string, replay []*pb.Message) *Durable {
+	d := &Durable{
+		identity: identity,
+		name:     name,
+		subject:  subject,
+	}
+	for _, msg := range replay {
+		d.keep(msg)
+	}
+	return d
+}
+
+func durableKey(identity, name string) string {
+	return identity + "\x00" + name
+}
+
+func (d *Durable) key() string {
+	return durableKey(d.identity, d.name)
+}
+
+func (d *Durable) Name() string {
+	return d.name
+}
+
+func (d *Durable) Subject() string {
+	return d.subject
+}
+
+// push keeps a message published to the subject and delivers it when a
+// connection is attached, deadline bounds the wait of the Block policy.
+func (d *Durable) push(msg *pb.Message, deadline time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if msg.Seq <= d.acked {
+		return
+	}
+	msg = d.keep(msg)
+	if d.acc != nil {
+		d.send(msg, deadline)
+	}
+}
+
+// keep appends a copy of msg naming the durable to the pending messages, the
+// oldest are dropped beyond the bounds.
+func (d *Durable) keep(msg *pb.Message) *pb.Message {
+	msg = &pb.Message{
+		Name:      msg.Name,
+		Data:      msg.Data,
+		Seq:       msg.Seq,
+		Timestamp: msg.Timestamp,
+		Retained:  msg.Retained,
+		Durable:   d.name,
+	}
+	d.pending = append(d.pending, msg)
+	d.size += len(msg.Data)
+
+	opts := durables.options()
+	n := 0
+	for len(d.pending)-n > 1 && ((opts.MaxPending > 0 && len(d.pending)-n > opts.MaxPending) ||
+		(opts.MaxPendingBytes > 0 && d.size > opts.MaxPendingBytes)) {
+		d.size -= len(d.pending[n].Data)
+		d.pending[n] = nil
+		n++
+	}
+	if n > 0 {
+		d.pending = d.pending[n:]
+		d.dropped += uint64(n)
+		log.Debug("Durable.keep: dropped %d pending messages, durable: %s, identity: %s", n, d.name, d.identity)
+	}
+	return msg
+}
+
+func (d *Durable) send(msg *pb.Message, deadline time.Time) {
+	if err := d.acc.deliver(msg, nil, deadline); err != nil {
+		log.Warn("Durable.send: write failed, durable: %s, cid: %s, err: %s", d.name, d.acc.ID(), err.Error())
+	}
+}
+
+// ack drops the pending messages up to and including seq.
+func (d *Durable) ack(seq uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if seq <= d.acked {
+		return
+	}
+	d.acked = seq
+	n := 0
+	for n < len(d.pending) && d.pending[n].Seq <= seq {
+		d.size -= len(d.pending[n].Data)
+		d.pending[n] = nil
+		n++
+	}
+	d.pending = d.pending[n:]
+}
+
+// attach delivers the pending messages and the following ones to acc, a
+// connection attached before is detached. The pending messages share a
+// single Block deadline. It returns false when the durable was removed.
+func (d *Durable) attach(acc *Account) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.stopped {
+		return false
+	}
+	if d.acc != nil && d.acc != acc {
+		d.acc.durables.Delete(d.name)
+		log.Info("Durable.attach: taken over, durable: %s, identity: %s, cid: %s", d.name, d.identity, d.acc.ID())
+	}
+	if d.expiry != nil {
+		d.expiry.Stop()
+		d.expiry = nil
+	}
+	d.acc = acc
+	acc.durables.Store(d.name, d)
+
+	deadline := backlogDeadline(acc.Conn().Server().Options().SlowConsumer)
+	for _, msg := range d.pending {
+		d.send(msg, deadline)
+	}
+	return true
+}
+
+// detach stops the delivery to acc, the messages are kept until the client
+// comes back or the durable expires.
+func (d *Durable) detach(acc *Account) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.acc != acc {
+		return
+	}
+	acc.durables.Delete(d.name)
+	d.acc = nil
+	if expire := durables.options().Expire; expire > 0 {
+		d.expiry = time.AfterFunc(expire, func() {
+			subscribe.expireDurable(d)
+		})
+	}
+}
+
+func (d *Durable) attached() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.acc != nil
+}
+
+// stop detaches the connection for good.
+func (d *Durable) stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.stopped = true
+	if d.acc != nil {
+		d.acc.durables.Delete(d.name)
+		d.acc = nil
+	}
+	if d.expiry != nil {
+		d.expiry.Stop()
+		d.expiry = nil
+	}
+}
+
+// Durables holds the durable subscriptions by identity and name.
+type Durables struct {
+	mu   sync.Mutex
+	subs map[string]*Durable
+	opts atomic.Value
+}
+
+func NewDurables() *Durables {
+	ds := &Durables{
+		subs: make(map[string]*Durable),
+	}
+	ds.opts.Store(&DurableOptions{})
+	return ds
+}
+
+var durables = NewDurables()
+
+func (ds *Durables) options() *DurableOptions {
+	return ds.opts.Load().(*DurableOptions)
+}
+
+func (ds *Durables) configure(opts *DurableOptions) {
+	if opts != nil {
+		ds.opts.Store(opts)
+	}
+}
+
+func (ds *Durables) get(identity, name string) (*Durable, bool) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	d, ok := ds.subs[durableKey(identity, name)]
+	return d, ok
+}
+
+func (ds *Durables) add(d *Durable) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	ds.subs[d.key()] = d
+}
+
+func (ds *Durables) remove(d *Durable) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if ds.subs[d.key()] == d {
+		delete(ds.subs, d.key())
+	}
+}
+
+// DetachAll detaches acc from its durables, called when its session
+// closes.
+func (ds *Durables) DetachAll(acc *Account) {
+	acc.durables.Range(func(_, value interface{}) bool {
+		value.(*Durable).detach(acc)
+		return true
+	})
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockUntil stands for a full queue under the Block policy, every send
+// waits for its deadline. It records the deadlines seen.
+func blockUntil(mu *sync.Mutex, deadlines *[]time.Time) func(SlowConsumerPolicy, time.Time) {
+	return func(policy SlowConsumerPolicy, deadline time.Time) {
+		mu.Lock()
+		*deadlines = append(*deadlines, deadline)
+		mu.Unlock()
+		if policy == Block && !deadline.IsZero() {
+			time.Sleep(time.Until(deadline))
+		}
+	}
+}
+
+func blockOptions() *Options {
+	opts := NewOptions()
+	opts.SlowConsumer.Policy = Block
+	opts.SlowConsumer.BlockTimeout = 50 * time.Millisecond
+	return opts
+}
+
+func TestSubscribeDurableBacklog(t *testing.T) {
+	defer durables.configure(durables.options())
+	durables.configure(&DurableOptions{MaxPending: 100})
+
+	const (
+		subject = "durable.backlog"
+		pending = 20
+	)
+	s := NewSubscribe()
+	opts := blockOptions()
+	identity := &Identity{Name: "backlog", Stable: true}
+
+	acc, _ := newTestAccount(opts)
+	acc.setIdentity(identity, nil)
+	d, err := s.SubscribeDurable(subject, "d", acc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.DeleteDurable(identity.Name, "d")
+	durables.DetachAll(acc)
+
+	for i := 0; i < pending; i++ {
+		s.Publish(subject, []byte("m"), false, time.Time{})
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		d.mu.Lock()
+		n := len(d.pending)
+		d.mu.Unlock()
+		if n == pending {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d pending messages, want %d", n, pending)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	var (
+		mu        sync.Mutex
+		deadlines []time.Time
+	)
+	acc, conn := newTestAccount(opts)
+	acc.setIdentity(identity, nil)
+	conn.onSend = blockUntil(&mu, &deadlines)
+
+	start := time.Now()
+	attached := make(chan error, 1)
+	go func() {
+		_, err := s.SubscribeDurable(subject, "d", acc, nil)
+		attached <- err
+	}()
+
+	// the subscription lock is not held while the backlog is sent
+	time.Sleep(5 * time.Millisecond)
+	other, _ := newTestAccount(opts)
+	subscribed := make(chan struct{})
+	go func() {
+		s.Subscribe("durable.other", other, nil)
+		close(subscribed)
+	}()
+	select {
+	case <-subscribed:
+	case <-time.After(opts.SlowConsumer.BlockTimeout / 2):
+		t.Fatal("Subscribe waited for the durable backlog")
+	}
+	s.UnSubscribe("durable.other", other)
+
+	if err := <-attached; err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 4*opts.SlowConsumer.BlockTimeout {
+		t.Fatalf("backlog of %d messages took %s, want a single block timeout", pending, elapsed)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(deadlines) != pending {
+		t.Fatalf("sent %d messages, want %d", len(deadlines), pending)
+	}
+	for _, dl := range deadlines {
+		if dl.IsZero() || !dl.Equal(deadlines[0]) {
+			t.Fatalf("deadlines %v, want a single one for the backlog", deadlines)
+		}
+	}
+}
+
+func TestSubscribeDurableRemoved(t *testing.T) {
+	s := NewSubscribe()
+	acc, _ := newTestAccount(NewOptions())
+	acc.setIdentity(&Identity{Name: "removed", Stable: true}, nil)
+
+	d, err := s.SubscribeDurable("durable.removed", "d", acc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.DeleteDurable("removed", "d") {
+		t.Fatal("DeleteDurable did not find the durable")
+	}
+	if d.attach(acc) {
+		t.Fatal("attach succeeded on a removed durable")
+	}
+	if _, ok := acc.durables.Load("d"); ok {
+		t.Fatal("removed durable attached to the account")
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/netraitcorp/netick/pb"
+)
+
+// fatalCodes lists the errors after which the connection is closed, the
+// others are reported and the client may go on.
+var fatalCodes = map[pb.ErrorCode]bool{
+	pb.ErrorCode_ERR_MALFORMED_FRAME:     true,
+	pb.ErrorCode_ERR_AUTH_FAILED:         true,
+	pb.ErrorCode_ERR_AUTH_TIMEOUT:        true,
+	pb.ErrorCode_ERR_INTERNAL:            true,
+	pb.ErrorCode_ERR_UNSUPPORTED_VERSION: true,
+	pb.ErrorCode_ERR_SLOW_CONSUMER:       true,
+}
+
+// Error is a failed client request, reported to the client with an
+// ErrorResp frame.
+type Error struct {
+	Code    pb.ErrorCode
+	Message string
+	// ID is the correlation id of the failed request, 0 when unknown.
+	ID uint64
+}
+
+func newError(code pb.ErrorCode, id uint64, format string, args ...interface{}) *Error {
+	return &Error{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+		ID:      id,
+	}
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code.String(), e.Message)
+}
+
+func (e *Error) Fatal() bool {
+	return fatalCodes[e.Code]
+}
+
+func (e *Error) resp() *pb.ErrorResp {
+	return &pb.ErrorResp{
+		Code:    e.Code,
+		Message: e.Message,
+		Id:      e.ID,
+		Fatal:   e.Fatal(),
+	}
+}
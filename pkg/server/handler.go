@@ -1,32 +1,39 @@
 package server
 
 import (
-	"fmt"
 	"sync"
 	"time"
 
 	"github.com/netraitcorp/netick/pb"
 	"github.com/netraitcorp/netick/pkg/log"
+	"github.com/netraitcorp/netick/pkg/metrics"
 	"github.com/netraitcorp/netick/pkg/types"
-	"github.com/netraitcorp/netick/pkg/util"
 )
 
 type Handler interface {
 	CreateConn()
 	Close()
 	ReadData(data []byte) error
+
+	// Features returns the protocol features negotiated with the client.
+	Features() uint32
 }
 
 type ReadHandler struct {
 	conn       Conn
+	acc        *Account
 	uid        string
 	authorized bool
+	hello      bool
+	version    uint32
+	features   uint32
 	mu         sync.Mutex
 	timer      *time.Timer
 }
 
 func (r *ReadHandler) CreateConn() {
-	accounts.AddAccount(NewAccount(r.conn))
+	r.acc = NewAccount(r.conn)
+	accounts.AddAccount(r.acc)
 	r.timer = time.AfterFunc(r.conn.Server().Options().Auth.Timeout, r.authorizeTimeoutCheck)
 }
 
@@ -36,46 +43,297 @@ func (r *ReadHandler) Close() {
 		r.timer = nil
 	}
 
-	accounts.RemoveAccount(r.conn.ConnID())
+	if r.acc == nil {
+		return
+	}
+	if r.authorized && sessions.suspend(r.acc, r.conn) {
+		return
+	}
+	sessions.discard(r.acc)
+	closeAccount(r.acc)
 }
 
-func (r *ReadHandler) ReadData(data []byte) (err error) {
+func (r *ReadHandler) ReadData(data []byte) error {
 	if len(data) == 0 {
-		return
+		return nil
 	}
 
-	opCode, payload, err := packet.Unmarshal(data)
+	opCode, payload, err := r.conn.Codec().Unmarshal(data)
 	if err != nil {
-		return err
+		log.Debug("ReadHandler.ReadData: unmarshal failed, cid: %s, err: %s", r.conn.ConnID(), err.Error())
+		return r.handleError(newError(pb.ErrorCode_ERR_MALFORMED_FRAME, 0, "malformed frame"))
+	}
+	if opCode == types.OpBatch {
+		return r.readBatch(payload.(*pb.Batch))
 	}
+	return r.handleError(r.dispatch(opCode, payload))
+}
+
+// readBatch handles the frames of a batch in order, as if they were sent one
+// by one.
+func (r *ReadHandler) readBatch(batch *pb.Batch) error {
+	for _, data := range batch.GetFrames() {
+		opCode, payload, err := r.conn.Codec().Unmarshal(data)
+		if err != nil {
+			log.Debug("ReadHandler.readBatch: unmarshal failed, cid: %s, err: %s", r.conn.ConnID(), err.Error())
+			return r.handleError(newError(pb.ErrorCode_ERR_MALFORMED_FRAME, 0, "malformed frame in batch"))
+		}
+		if opCode == types.OpBatch {
+			err = newError(pb.ErrorCode_ERR_PROTOCOL, 0, "nested batch")
+		} else {
+			err = r.dispatch(opCode, payload)
+		}
+		if err := r.handleError(err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *ReadHandler) dispatch(opCode types.OpCode, payload interface{}) error {
 	switch opCode {
+	case types.OpPing:
+		return r.pong(payload.(*pb.Ping))
+	case types.OpPong:
+		rtt := sinceTimestamp(payload.(*pb.Pong).GetTimestamp())
+		r.conn.Heartbeat(rtt)
+		log.Debug("ReadHandler: pong, cid: %s, rtt: %s", r.conn.ConnID(), rtt.String())
+		return nil
+	case types.OpHello:
+		return r.helloHandshake(payload.(*pb.HelloReq))
 	case types.OpAuth:
-		err = r.authorize(payload.(*pb.AuthReq))
+		return r.authorize(payload.(*pb.AuthReq))
+	case types.OpResume:
+		return r.resume(payload.(*pb.ResumeReq))
 	case types.OpSubscribe:
-		err = r.subscribe(payload.(*pb.SubscribeReq))
+		return r.subscribe(payload.(*pb.SubscribeReq))
+	case types.OpUnsubscribe:
+		return r.unsubscribe(payload.(*pb.UnsubscribeReq))
+	case types.OpPublish:
+		return r.publish(payload.(*pb.PublishReq))
+	case types.OpMessageAck:
+		return r.messageAck(payload.(*pb.MessageAck))
 	}
-	return
+	return newError(pb.ErrorCode_ERR_UNKNOWN_OPCODE, 0, "unknown opcode 0x%02x", uint8(opCode))
 }
 
-func (r *ReadHandler) subscribe(req *pb.SubscribeReq) error {
+// handleError reports a failed request to the client. Only errors the
+// connection must be closed for are returned.
+func (r *ReadHandler) handleError(err error) error {
+	if err == nil {
+		return nil
+	}
+	e, ok := err.(*Error)
+	if !ok {
+		return err
+	}
+
+	log.Warn("ReadHandler: request failed, cid: %s, err: %s", r.conn.ConnID(), e.Error())
+	if err := r.writeError(e); err != nil {
+		return err
+	}
+	if e.Fatal() {
+		return e
+	}
 	return nil
 }
 
-func (r *ReadHandler) authorize(req *pb.AuthReq) error {
-	pass := r.conn.Server().Options().Auth.Password
-	if pass != "" {
-		if req.GetPassword() == "" {
-			return fmt.Errorf("ReadHandler.authorize: password empty, cid: %s", r.conn.ConnID())
+func (r *ReadHandler) Features() uint32 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.features
+}
+
+// helloHandshake negotiates the protocol version and features, it must
+// precede authorization. Newer clients are downgraded to the server version,
+// older than MinProtocolVersion are rejected.
+func (r *ReadHandler) helloHandshake(req *pb.HelloReq) error {
+	if r.hello || r.authorized {
+		return newError(pb.ErrorCode_ERR_PROTOCOL, 0, "hello must be sent once, before authorization")
+	}
+	if req.GetVersion() < types.MinProtocolVersion {
+		return newError(pb.ErrorCode_ERR_UNSUPPORTED_VERSION, 0,
+			"protocol version %d not supported, server accepts %d to %d", req.GetVersion(), types.MinProtocolVersion, types.ProtocolVersion)
+	}
+
+	version := req.GetVersion()
+	if version > types.ProtocolVersion {
+		version = types.ProtocolVersion
+	}
+	features := req.GetFeatures() & types.ServerFeatures
+
+	r.mu.Lock()
+	r.hello = true
+	r.version = version
+	r.features = features
+	r.mu.Unlock()
+
+	data, err := r.conn.Codec().Marshal(types.OpHelloRet, &pb.HelloResp{
+		Version:  version,
+		Features: features,
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Info("ReadHandler.helloHandshake: client: %s, version: %d, features: %#x, cid: %s",
+		req.GetClient(), version, features, r.conn.ConnID())
+	return r.conn.Write(data)
+}
+
+// pong answers a ping of the client, echoing its timestamp.
+func (r *ReadHandler) pong(req *pb.Ping) error {
+	r.conn.Heartbeat(0)
+
+	data, err := r.conn.Codec().Marshal(types.OpPong, &pb.Pong{
+		Timestamp: req.GetTimestamp(),
+	})
+	if err != nil {
+		return err
+	}
+	return r.conn.Write(data)
+}
+
+func (r *ReadHandler) subscribe(req *pb.SubscribeReq) error {
+	if !r.authorized {
+		return newError(pb.ErrorCode_ERR_UNAUTHORIZED, req.GetId(), "not authorized")
+	}
+	if !ValidSubscribeSubject(req.GetName()) {
+		return newError(pb.ErrorCode_ERR_INVALID_SUBJECT, req.GetId(), "invalid topic name %q", req.GetName())
+	}
+	if !r.acc.Permissions().CanSubscribe(req.GetName()) {
+		return newError(pb.ErrorCode_ERR_PERMISSION_DENIED, req.GetId(), "subscribe to %s not permitted", req.GetName())
+	}
+
+	replay, err := replayOf(req)
+	if err != nil {
+		return err
+	}
+	if name := req.GetDurable(); name != "" {
+		if !r.acc.Identity().Stable {
+			return newError(pb.ErrorCode_ERR_PROTOCOL, req.GetId(), "durable subscriptions require a token or client certificate identity")
+		}
+		if _, err := subscribe.SubscribeDurable(req.GetName(), name, r.acc, replay); err != nil {
+			return newError(pb.ErrorCode_ERR_PROTOCOL, req.GetId(), "%s", err.Error())
+		}
+		log.Info("ReadHandler.subscribe: durable: %s, topic: %s, cid: %s", name, req.GetName(), r.conn.ConnID())
+		return r.ack(req.GetId())
+	}
+	subscribe.Subscribe(req.GetName(), r.acc, replay)
+
+	log.Info("ReadHandler.subscribe: topic: %s, cid: %s", req.GetName(), r.conn.ConnID())
+	return r.ack(req.GetId())
+}
+
+// replayOf returns the history requested by a subscription, at most one of
+// the replay fields may be set.
+func replayOf(req *pb.SubscribeReq) (*Replay, error) {
+	replay := &Replay{
+		Seq:  req.GetReplaySeq(),
+		Last: int(req.GetReplayLast()),
+	}
+	if ms := req.GetReplayTime(); ms > 0 {
+		replay.Time = time.Unix(0, ms*int64(time.Millisecond))
+	}
+
+	n := 0
+	for _, set := range []bool{replay.Seq > 0, !replay.Time.IsZero(), replay.Last > 0} {
+		if set {
+			n++
 		}
-		if req.GetPassword() != util.Sha1(pass) {
-			return fmt.Errorf("ReadHandler.authorize: password incorrect, cid: %s", r.conn.ConnID())
+	}
+	if n > 1 {
+		return nil, newError(pb.ErrorCode_ERR_PROTOCOL, req.GetId(), "replay_seq, replay_time and replay_last are exclusive")
+	}
+	return replay, nil
+}
+
+func (r *ReadHandler) unsubscribe(req *pb.UnsubscribeReq) error {
+	if !r.authorized {
+		return newError(pb.ErrorCode_ERR_UNAUTHORIZED, req.GetId(), "not authorized")
+	}
+	if name := req.GetDurable(); name != "" {
+		if subscribe.DeleteDurable(r.acc.Identity().Name, name) {
+			log.Info("ReadHandler.unsubscribe: deleted durable: %s, cid: %s", name, r.conn.ConnID())
 		}
+	} else if req.GetName() == "" {
+		return newError(pb.ErrorCode_ERR_INVALID_SUBJECT, req.GetId(), "topic name empty")
+	} else if subscribe.UnSubscribe(req.GetName(), r.acc) {
+		log.Info("ReadHandler.unsubscribe: topic: %s, cid: %s", req.GetName(), r.conn.ConnID())
+	}
+
+	data, err := r.conn.Codec().Marshal(types.OpUnsubscribeRet, &pb.UnsubscribeResp{
+		Name: req.GetName(),
+		Id:   req.GetId(),
+	})
+	if err != nil {
+		return err
+	}
+	return r.conn.Write(data)
+}
+
+func (r *ReadHandler) publish(req *pb.PublishReq) error {
+	if !r.authorized {
+		return newError(pb.ErrorCode_ERR_UNAUTHORIZED, req.GetId(), "not authorized")
+	}
+	if !ValidPublishSubject(req.GetName()) {
+		return newError(pb.ErrorCode_ERR_INVALID_SUBJECT, req.GetId(), "invalid topic name %q", req.GetName())
 	}
+	if !r.acc.Permissions().CanPublish(req.GetName()) {
+		return newError(pb.ErrorCode_ERR_PERMISSION_DENIED, req.GetId(), "publish to %s not permitted", req.GetName())
+	}
+
+	deadline := blockDeadline(r.conn.Server().Options().SlowConsumer, req.GetName())
+	subscribe.Publish(req.GetName(), req.GetData(), req.GetRetain(), deadline)
+
+	return r.ack(req.GetId())
+}
+
+// messageAck acknowledges the messages of a durable subscription attached
+// to the connection.
+func (r *ReadHandler) messageAck(req *pb.MessageAck) error {
+	if !r.authorized {
+		return newError(pb.ErrorCode_ERR_UNAUTHORIZED, 0, "not authorized")
+	}
+	d, ok := r.acc.durables.Load(req.GetDurable())
+	if !ok {
+		return newError(pb.ErrorCode_ERR_PROTOCOL, 0, "durable %q not subscribed", req.GetDurable())
+	}
+	d.(*Durable).ack(req.GetSeq())
+	return nil
+}
+
+// authorize authenticates the connection, once: the identity and the
+// permissions its subscriptions were checked against cannot be replaced.
+func (r *ReadHandler) authorize(req *pb.AuthReq) error {
+	if r.authorized {
+		return newError(pb.ErrorCode_ERR_PROTOCOL, req.GetId(), "already authorized")
+	}
+	authOpts := r.conn.Server().Options().Auth
+	identity, err := authOpts.authenticator().Authenticate(r.conn, req)
+	if err != nil {
+		log.Info("ReadHandler.authorize: %s", err.Error())
+		metrics.Auths.WithLabelValues("failure").Inc()
+		return newError(pb.ErrorCode_ERR_AUTH_FAILED, req.GetId(), "authentication failed")
+	}
+	r.acc.setIdentity(identity, authOpts.permissions(identity))
 	r.authorized = true
+	metrics.Auths.WithLabelValues("success").Inc()
+
+	var token string
+	if r.Features()&types.FeatureResume != 0 {
+		if token, err = sessions.open(r.acc); err != nil {
+			log.Error("ReadHandler.authorize: %s", err.Error())
+		}
+	}
 
-	data, err := packet.Marshal(types.OpAuthRet, &pb.AuthResp{
-		ConnId:     r.conn.ConnID(),
-		Authorized: true,
+	data, err := r.conn.Codec().Marshal(types.OpAuthRet, &pb.AuthResp{
+		ConnId:      r.conn.ConnID(),
+		Authorized:  true,
+		Identity:    identity.Name,
+		Id:          req.GetId(),
+		ResumeToken: token,
 	})
 	if err != nil {
 		return err
@@ -85,20 +343,86 @@ func (r *ReadHandler) authorize(req *pb.AuthReq) error {
 		return err
 	}
 
-	log.Info("ReadHandler.authorize: verified, cid: %s", r.conn.ConnID())
+	log.Info("ReadHandler.authorize: verified, cid: %s, identity: %s", r.conn.ConnID(), identity.Name)
+	return nil
+}
+
+// resume reattaches a suspended session to the connection in place of
+// authorization, the frames the lost connection did not send and the
+// messages buffered since follow the AuthResp.
+func (r *ReadHandler) resume(req *pb.ResumeReq) error {
+	if r.authorized {
+		return newError(pb.ErrorCode_ERR_PROTOCOL, req.GetId(), "resume must be sent instead of authorization")
+	}
+	acc, token, old, err := sessions.resume(req.GetToken(), r.conn)
+	if err != nil {
+		log.Info("ReadHandler.resume: %s, cid: %s", err.Error(), r.conn.ConnID())
+		metrics.Auths.WithLabelValues("failure").Inc()
+		return newError(pb.ErrorCode_ERR_AUTH_FAILED, req.GetId(), "%s", ErrSessionNotFound.Error())
+	}
+	accounts.RemoveAccount(r.acc.ID())
+	r.acc = acc
+	r.authorized = true
+	metrics.Auths.WithLabelValues("resumed").Inc()
+
+	// the lost connection may not have been noticed yet
+	_ = old.Close()
+	unsent := old.Unsent()
+
+	data, err := r.conn.Codec().Marshal(types.OpAuthRet, &pb.AuthResp{
+		ConnId:      acc.ID(),
+		Authorized:  true,
+		Identity:    acc.Identity().Name,
+		Id:          req.GetId(),
+		ResumeToken: token,
+		Resumed:     true,
+	})
+	if err != nil {
+		return err
+	}
+	if err := r.conn.Write(data); err != nil {
+		return err
+	}
+	acc.resume(unsent, old.Codec())
+
+	log.Info("ReadHandler.resume: session: %s, cid: %s, unsent: %d", acc.ID(), r.conn.ConnID(), len(unsent))
 	return nil
 }
 
+// ack confirms a request, requests without id are not acknowledged.
+func (r *ReadHandler) ack(id uint64) error {
+	if id == 0 {
+		return nil
+	}
+	data, err := r.conn.Codec().Marshal(types.OpAck, &pb.Ack{
+		Id: id,
+	})
+	if err != nil {
+		return err
+	}
+	return r.conn.Write(data)
+}
+
+func (r *ReadHandler) writeError(e *Error) error {
+	data, err := r.conn.Codec().Marshal(types.OpError, e.resp())
+	if err != nil {
+		return err
+	}
+	return r.conn.Write(data)
+}
+
 func (r *ReadHandler) authorizeTimeoutCheck() {
 	if r.authorized {
 		return
 	}
 	log.Info("ReadHandler.authorizeTimeoutCheck: cid: %s", r.conn.ConnID())
-	_ = r.conn.Close()
+	_ = r.writeError(newError(pb.ErrorCode_ERR_AUTH_TIMEOUT, 0, "no authentication within %s", r.conn.Server().Options().Auth.Timeout))
+	flushAndClose(r.conn)
 }
 
 func NewReadHandler(c Conn) *ReadHandler {
 	return &ReadHandler{
-		conn: c,
+		conn:    c,
+		version: types.MinProtocolVersion,
 	}
 }
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/netraitcorp/netick/pb"
+	"github.com/netraitcorp/netick/pkg/types"
+	"github.com/netraitcorp/netick/pkg/util"
+)
+
+const testPassword = "secret"
+
+func handlerOptions() *Options {
+	opts := NewOptions()
+	opts.Auth.Password = testPassword
+	opts.Session.Grace = time.Minute
+	return opts
+}
+
+// newTestHandler returns the handler of a new connection to a server using
+// opts.
+func newTestHandler(opts *Options) (*ReadHandler, *recordConn) {
+	conn := newRecordConn(newTestServer(opts))
+	r := NewReadHandler(conn)
+	r.CreateConn()
+	return r, conn
+}
+
+// authorizeResumable authenticates r with the resume feature and returns its
+// resume token.
+func authorizeResumable(t *testing.T, r *ReadHandler, conn *recordConn) string {
+	t.Helper()
+	if err := r.dispatch(types.OpHello, &pb.HelloReq{Version: types.ProtocolVersion, Features: types.FeatureResume}); err != nil {
+		t.Fatalf("hello: %s", err.Error())
+	}
+	if err := r.dispatch(types.OpAuth, &pb.AuthReq{Password: util.Sha1(testPassword), Id: 1}); err != nil {
+		t.Fatalf("auth: %s", err.Error())
+	}
+	resp := &pb.AuthResp{}
+	if !conn.lastFrame(types.OpAuthRet, resp) || resp.GetResumeToken() == "" {
+		t.Fatalf("AuthResp %+v, want a resume token", resp)
+	}
+	return resp.GetResumeToken()
+}
+
+func wantErrorCode(t *testing.T, err error, code pb.ErrorCode) {
+	t.Helper()
+	e, ok := err.(*Error)
+	if !ok || e.Code != code {
+		t.Fatalf("got error %v, want %s", err, code)
+	}
+}
+
+func TestHandlerAuthorizeOnce(t *testing.T) {
+	defer sessions.configure(sessions.options())
+	opts := handlerOptions()
+	sessions.configure(opts.Session)
+
+	tests := []struct {
+		name    string
+		resumed bool
+	}{
+		{name: "authorized"},
+		{name: "resumed", resumed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, conn := newTestHandler(opts)
+			defer r.Close()
+			token := authorizeResumable(t, r, conn)
+
+			if tt.resumed {
+				r.Close()
+				r, conn = newTestHandler(opts)
+				defer r.Close()
+				if err := r.dispatch(types.OpResume, &pb.ResumeReq{Token: token, Id: 2}); err != nil {
+					t.Fatalf("resume: %s", err.Error())
+				}
+			}
+			acc := r.acc
+			identity := acc.Identity()
+
+			err := r.dispatch(types.OpAuth, &pb.AuthReq{Password: util.Sha1(testPassword), Id: 3})
+			wantErrorCode(t, err, pb.ErrorCode_ERR_PROTOCOL)
+			if r.acc != acc || acc.Identity() != identity {
+				t.Fatal("a second AuthReq replaced the identity")
+			}
+		})
+	}
+}
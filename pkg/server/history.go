@@ -0,0 +1,223 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/netraitcorp/netick/pb"
+)
+
+// Replay selects the history delivered to a new subscription before live
+// messages, at most one field is set. The zero Replay delivers nothing.
+type Replay struct {
+	// Seq replays the messages from this sequence number on.
+	Seq uint64
+	// Time replays the messages published from this time on.
+	Time time.Time
+	// Last replays the last Last messages.
+	Last int
+}
+
+func (r *Replay) empty() bool {
+	return r == nil || (r.Seq == 0 && r.Time.IsZero() && r.Last == 0)
+}
+
+// History assigns the sequence numbers of published messages and keeps the
+// latest of every subject, bounded by HistoryOptions. The subjects are swept
+// periodically so that the ones no longer published to do not outlive MaxAge.
+type History struct {
+	mu       sync.Mutex
+	seq      uint64
+	subjects map[string]*subjectHistory
+	opts     atomic.Value
+	sweeper  sync.Once
+}
+
+// historySweepInterval is the period subjects are trimmed and the empty ones
+// dropped at.
+const historySweepInterval = time.Minute
+
+type subjectHistory struct {
+	msgs []*pb.Message
+	size int
+}
+
+func NewHistory() *History {
+	h := &History{
+		subjects: make(map[string]*subjectHistory),
+	}
+	h.opts.Store(&HistoryOptions{})
+	return h
+}
+
+var history = NewHistory()
+
+func (h *History) options() *HistoryOptions {
+	return h.opts.Load().(*HistoryOptions)
+}
+
+// configure sets the bounds applied from the next message on, the kept
+// messages are trimmed to them by the next sweep.
+func (h *History) configure(opts *HistoryOptions) {
+	if opts != nil {
+		h.opts.Store(opts)
+	}
+	h.sweeper.Do(func() {
+		go h.sweepLoop()
+	})
+}
+
+func (h *History) sweepLoop() {
+	ticker := time.NewTicker(historySweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		h.sweep()
+	}
+}
+
+// sweep trims the messages of every subject and drops the subjects left
+// empty, all of them when history is disabled.
+func (h *History) sweep() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	opts := h.options()
+	for subject, sh := range h.subjects {
+		if opts.MaxMessages > 0 {
+			sh.trim(opts)
+		}
+		if opts.MaxMessages <= 0 || len(sh.msgs) == 0 {
+			delete(h.subjects, subject)
+		}
+	}
+}
+
+// LastSeq returns the sequence number of the last published message.
+func (h *History) LastSeq() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.seq
+}
+
+// append assigns the next sequence number to a message published to
+// subject and keeps it when history is enabled.
+func (h *History) append(subject string, data []byte) *pb.Message {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.seq++
+	msg := &pb.Message{
+		Name:      subject,
+		Data:      data,
+		Seq:       h.seq,
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+	}
+
+	h.keep(msg)
+	return msg
+}
+
+// restore keeps a message recovered from the durable log, sequence numbers
+// continue after it.
+func (h *History) restore(msg *pb.Message) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.advance(msg.Seq)
+	h.keep(msg)
+}
+
+// advance makes the sequence numbers continue after seq.
+func (h *History) advance(seq uint64) {
+	if seq > h.seq {
+		h.seq = seq
+	}
+}
+
+func (h *History) keep(msg *pb.Message) {
+	opts := h.options()
+	if opts.MaxMessages <= 0 {
+		return
+	}
+	sh, ok := h.subjects[msg.Name]
+	if !ok {
+		sh = &subjectHistory{}
+		h.subjects[msg.Name] = sh
+	}
+	sh.msgs = append(sh.msgs, msg)
+	sh.size += len(msg.Data)
+	sh.trim(opts)
+}
+
+// trim drops the oldest messages exceeding opts, the latest message is
+// always kept.
+func (sh *subjectHistory) trim(opts *HistoryOptions) {
+	var oldest int64
+	if opts.MaxAge > 0 {
+		oldest = time.Now().Add(-opts.MaxAge).UnixNano() / int64(time.Millisecond)
+	}
+
+	n := 0
+	for n < len(sh.msgs) {
+		rest := len(sh.msgs) - n
+		msg := sh.msgs[n]
+		if rest > opts.MaxMessages || (opts.MaxBytes > 0 && sh.size > opts.MaxBytes && rest > 1) ||
+			(oldest > 0 && msg.Timestamp < oldest) {
+			sh.size -= len(msg.Data)
+			sh.msgs[n] = nil
+			n++
+			continue
+		}
+		break
+	}
+	sh.msgs = sh.msgs[n:]
+}
+
+// replay returns the kept messages of the subjects matching pattern that are
+// selected by r, ordered by sequence number.
+func (h *History) replay(pattern string, r *Replay) []*pb.Message {
+	if r.empty() {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	opts := h.options()
+	var msgs []*pb.Message
+	for subject, sh := range h.subjects {
+		if !subjectCovers(pattern, subject) {
+			continue
+		}
+		sh.trim(opts)
+		if len(sh.msgs) == 0 {
+			delete(h.subjects, subject)
+			continue
+		}
+		msgs = append(msgs, sh.msgs...)
+	}
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].Seq < msgs[j].Seq
+	})
+
+	switch {
+	case r.Seq > 0:
+		i := sort.Search(len(msgs), func(i int) bool {
+			return msgs[i].Seq >= r.Seq
+		})
+		msgs = msgs[i:]
+	case !r.Time.IsZero():
+		ts := r.Time.UnixNano() / int64(time.Millisecond)
+		i := sort.Search(len(msgs), func(i int) bool {
+			return msgs[i].Timestamp >= ts
+		})
+		msgs = msgs[i:]
+	case r.Last > 0 && len(msgs) > r.Last:
+		msgs = msgs[len(msgs)-r.Last:]
+	}
+	return msgs
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/netraitcorp/netick/pb"
+	"github.com/netraitcorp/netick/pkg/log"
+	"github.com/netraitcorp/netick/pkg/store"
+	"google.golang.org/protobuf/proto"
+)
+
+// Journal persists the published messages and the retained values to the
+// durable log, it does nothing until Restore attached a log.
+type Journal struct {
+	log *store.Log
+}
+
+var journal = &Journal{}
+
+// Restore rebuilds history and retained values from l, then persists the
+// messages published from now on to it. It must be called after Configure
+// and before the servers start.
+func Restore(l *store.Log) error {
+	n := 0
+	err := l.Replay(func(data []byte) error {
+		rec := &pb.LogRecord{}
+		if err := proto.Unmarshal(data, rec); err != nil {
+			return fmt.Errorf("unmarshal record: %s", err.Error())
+		}
+		n++
+
+		msg := rec.GetMessage()
+		switch {
+		case rec.GetClear() != "":
+			retained.Clear(rec.GetClear())
+		case msg == nil && rec.GetSeq() > 0:
+			history.advance(rec.GetSeq())
+		case msg == nil:
+			return fmt.Errorf("record without message")
+		case rec.GetSnapshot():
+			history.advance(msg.Seq)
+			retained.store(msg)
+		default:
+			history.restore(msg)
+			if rec.GetRetain() {
+				retained.store(msg)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Restore: %s", err.Error())
+	}
+
+	journal.log = l
+	l.OnRoll(journal.snapshot)
+
+	log.Info("Restore: %d records, %d retained values, last seq: %d", n, len(retained.values()), history.LastSeq())
+	return nil
+}
+
+// snapshot copies the last sequence number and the retained values to the
+// start of a new segment, they outlive the removal of the segments they were
+// published in.
+func (j *Journal) snapshot() [][]byte {
+	var recs [][]byte
+	if seq := history.LastSeq(); seq > 0 {
+		data, err := proto.Marshal(&pb.LogRecord{
+			Seq: seq,
+		})
+		if err != nil {
+			log.Error("Journal.snapshot: marshal failed, seq: %d, err: %s", seq, err.Error())
+		} else {
+			recs = append(recs, data)
+		}
+	}
+	for _, msg := range retained.values() {
+		data, err := proto.Marshal(&pb.LogRecord{
+			Message:  msg,
+			Snapshot: true,
+		})
+		if err != nil {
+			log.Error("Journal.snapshot: marshal failed, subject: %s, err: %s", msg.Name, err.Error())
+			continue
+		}
+		recs = append(recs, data)
+	}
+	return recs
+}
+
+// append persists a published message, only retained ones while history is
+// disabled since Restore would drop the others.
+func (j *Journal) append(msg *pb.Message, retain bool) {
+	if !retain && history.options().MaxMessages <= 0 {
+		return
+	}
+	j.write(&pb.LogRecord{
+		Message: msg,
+		Retain:  retain,
+	})
+}
+
+func (j *Journal) clear(subject string) {
+	j.write(&pb.LogRecord{
+		Clear: subject,
+	})
+}
+
+func (j *Journal) write(rec *pb.LogRecord) {
+	if j.log == nil {
+		return
+	}
+	data, err := proto.Marshal(rec)
+	if err == nil {
+		err = j.log.Append(data)
+	}
+	if err != nil {
+		log.Error("Journal.write: %s", err.Error())
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/netraitcorp/netick/pkg/store"
+)
+
+func TestJournalSeqOutlivesSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netick-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(h *History) { history = h }(history)
+	defer func() { journal.log = nil }()
+	history = NewHistory()
+	history.configure(&HistoryOptions{MaxMessages: 10})
+
+	opts := store.NewOptions()
+	opts.Dir = dir
+	opts.MaxAge = 20 * time.Millisecond
+	l, err := store.Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Restore(l); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewSubscribe()
+	for i := 0; i < 5; i++ {
+		s.Publish("journal.seq", []byte("data"), false, time.Time{})
+	}
+	last := history.LastSeq()
+
+	// the segment holding the messages expires, a new one is started
+	time.Sleep(2 * opts.MaxAge)
+	if err := l.EnforceRetention(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	history = NewHistory()
+	history.configure(&HistoryOptions{MaxMessages: 10})
+	l, err = store.Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := Restore(l); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(history.replay("journal.seq", &Replay{Seq: 1})); n != 0 {
+		t.Fatalf("restored %d messages, want the expired segment removed", n)
+	}
+	if seq := history.LastSeq(); seq != last {
+		t.Fatalf("restored last seq %d, want %d", seq, last)
+	}
+	if msg := history.append("journal.seq", nil); msg.Seq != last+1 {
+		t.Fatalf("next message got seq %d, want %d", msg.Seq, last+1)
+	}
+}
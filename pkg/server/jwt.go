@@ -0,0 +1,306 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/netraitcorp/netick/pb"
+)
+
+type JWTOptions struct {
+	// Algorithms accepted in the token header, HS256, RS256 and ES256 are
+	// supported.
+	Algorithms []string
+	// Secret is the HMAC key for HS256.
+	Secret string
+	// PublicKeyFile is a PEM encoded RSA or ECDSA public key.
+	PublicKeyFile string
+	// JWKSFile is a local JSON Web Key Set, keys are selected by the kid
+	// header of the token.
+	JWKSFile string
+	Issuer   string
+	Audience string
+	// Leeway tolerates clock skew when checking exp, nbf and iat.
+	Leeway time.Duration
+	// IdentityClaim names the claim holding the user identity, "sub" by
+	// default.
+	IdentityClaim string
+}
+
+// JWTAuthenticator validates the token of an AuthReq, the token must carry
+// an expiry. An optional "permissions" claim of the form
+// {"publish": [...], "subscribe": [...]} overrides the configured permissions.
+type JWTAuthenticator struct {
+	opts   JWTOptions
+	parser *jwt.Parser
+	hmac   []byte
+	pub    interface{}
+	jwks   map[string]interface{}
+}
+
+func NewJWTAuthenticator(opts *JWTOptions) (*JWTAuthenticator, error) {
+	a := &JWTAuthenticator{
+		opts: *opts,
+	}
+	if a.opts.IdentityClaim == "" {
+		a.opts.IdentityClaim = "sub"
+	}
+	if len(a.opts.Algorithms) == 0 {
+		return nil, fmt.Errorf("NewJWTAuthenticator: no algorithm allowed")
+	}
+	for _, alg := range a.opts.Algorithms {
+		switch alg {
+		case "HS256", "RS256", "ES256":
+		default:
+			return nil, fmt.Errorf("NewJWTAuthenticator: unsupported algorithm %q", alg)
+		}
+	}
+	a.parser = &jwt.Parser{ValidMethods: a.opts.Algorithms}
+
+	if opts.Secret != "" {
+		a.hmac = []byte(opts.Secret)
+	}
+	if opts.PublicKeyFile != "" {
+		pub, err := loadPublicKey(opts.PublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		a.pub = pub
+	}
+	if opts.JWKSFile != "" {
+		keys, err := loadJWKS(opts.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		a.jwks = keys
+	}
+	if a.hmac == nil && a.pub == nil && a.jwks == nil {
+		return nil, fmt.Errorf("NewJWTAuthenticator: one of secret, public key file or jwks file is required")
+	}
+	return a, nil
+}
+
+func (a *JWTAuthenticator) Authenticate(conn Conn, req *pb.AuthReq) (*Identity, error) {
+	if req.GetToken() == "" {
+		return nil, fmt.Errorf("JWTAuthenticator.Authenticate: token empty, cid: %s", conn.ConnID())
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := a.parser.ParseWithClaims(req.GetToken(), claims, a.keyFunc)
+	if err != nil && !a.skewOnly(err, claims) {
+		return nil, fmt.Errorf("JWTAuthenticator.Authenticate: invalid token, cid: %s, err: %s", conn.ConnID(), err.Error())
+	}
+
+	if _, ok := claims["exp"]; !ok {
+		return nil, fmt.Errorf("JWTAuthenticator.Authenticate: token without expiry, cid: %s", conn.ConnID())
+	}
+	if a.opts.Issuer != "" && !claims.VerifyIssuer(a.opts.Issuer, true) {
+		return nil, fmt.Errorf("JWTAuthenticator.Authenticate: unexpected issuer, cid: %s", conn.ConnID())
+	}
+	if a.opts.Audience != "" && !claims.VerifyAudience(a.opts.Audience, true) {
+		return nil, fmt.Errorf("JWTAuthenticator.Authenticate: unexpected audience, cid: %s", conn.ConnID())
+	}
+
+	name, _ := claims[a.opts.IdentityClaim].(string)
+	if name == "" {
+		return nil, fmt.Errorf("JWTAuthenticator.Authenticate: claim %s missing, cid: %s", a.opts.IdentityClaim, conn.ConnID())
+	}
+	perms, err := claimPermissions(claims["permissions"])
+	if err != nil {
+		return nil, fmt.Errorf("JWTAuthenticator.Authenticate: claim permissions invalid, cid: %s, err: %s", conn.ConnID(), err.Error())
+	}
+	return &Identity{Name: name, Permissions: perms, Stable: true}, nil
+}
+
+func claimPermissions(claim interface{}) (*Permissions, error) {
+	if claim == nil {
+		return nil, nil
+	}
+	m, ok := claim.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("not an object")
+	}
+	publish, err := claimStrings(m["publish"])
+	if err != nil {
+		return nil, fmt.Errorf("publish: %s", err.Error())
+	}
+	subscribe, err := claimStrings(m["subscribe"])
+	if err != nil {
+		return nil, fmt.Errorf("subscribe: %s", err.Error())
+	}
+	return NewPermissions(publish, subscribe)
+}
+
+func claimStrings(claim interface{}) ([]string, error) {
+	if claim == nil {
+		return nil, nil
+	}
+	list, ok := claim.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("not an array")
+	}
+	ss := make([]string, 0, len(list))
+	for _, v := range list {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("not an array of strings")
+		}
+		ss = append(ss, s)
+	}
+	return ss, nil
+}
+
+// skewOnly reports whether err only comes from the time based claims and
+// these are still valid once the configured leeway is allowed for, the
+// parser itself does not support a leeway.
+func (a *JWTAuthenticator) skewOnly(err error, claims jwt.MapClaims) bool {
+	ve, ok := err.(*jwt.ValidationError)
+	if !ok || a.opts.Leeway <= 0 {
+		return false
+	}
+	timing := uint32(jwt.ValidationErrorExpired | jwt.ValidationErrorNotValidYet | jwt.ValidationErrorIssuedAt)
+	if ve.Errors&^timing != 0 {
+		return false
+	}
+
+	now := time.Now()
+	return claims.VerifyExpiresAt(now.Add(-a.opts.Leeway).Unix(), false) &&
+		claims.VerifyNotBefore(now.Add(a.opts.Leeway).Unix(), false) &&
+		claims.VerifyIssuedAt(now.Add(a.opts.Leeway).Unix(), false)
+}
+
+func (a *JWTAuthenticator) keyFunc(token *jwt.Token) (interface{}, error) {
+	if kid, ok := token.Header["kid"].(string); ok && a.jwks != nil {
+		key, ok := a.jwks[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown key id %q", kid)
+		}
+		return matchKey(token.Method, key)
+	}
+
+	switch token.Method.(type) {
+	case *jwt.SigningMethodHMAC:
+		if a.hmac == nil {
+			return nil, fmt.Errorf("no secret configured")
+		}
+		return a.hmac, nil
+	default:
+		if a.pub == nil {
+			return nil, fmt.Errorf("no public key configured")
+		}
+		return matchKey(token.Method, a.pub)
+	}
+}
+
+// matchKey makes sure the key type is the one expected by the algorithm, so
+// a public key can never be used as an HMAC secret.
+func matchKey(method jwt.SigningMethod, key interface{}) (interface{}, error) {
+	ok := false
+	switch method.(type) {
+	case *jwt.SigningMethodHMAC:
+		_, ok = key.([]byte)
+	case *jwt.SigningMethodRSA:
+		_, ok = key.(*rsa.PublicKey)
+	case *jwt.SigningMethodECDSA:
+		_, ok = key.(*ecdsa.PublicKey)
+	}
+	if !ok {
+		return nil, fmt.Errorf("key type does not match algorithm %s", method.Alg())
+	}
+	return key, nil
+}
+
+func loadPublicKey(filename string) (interface{}, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(data); err == nil {
+		return key, nil
+	}
+	if key, err := jwt.ParseECPublicKeyFromPEM(data); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("loadPublicKey: no RSA or ECDSA public key found in %s", filename)
+}
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+func loadJWKS(filename string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("loadJWKS: %s", err.Error())
+	}
+
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, k := range set.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("loadJWKS: key %q: %s", k.Kid, err.Error())
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+func (k *jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	case "oct":
+		return base64.RawURLEncoding.DecodeString(k.K)
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
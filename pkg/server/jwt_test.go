@@ -0,0 +1,330 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/netraitcorp/netick/pb"
+)
+
+type testConn struct {
+	Conn
+}
+
+func (c *testConn) ConnID() string {
+	return "test"
+}
+
+const testSecret = "topsecret"
+
+type jwtKeys struct {
+	dir     string
+	rsa     *rsa.PrivateKey
+	pemFile string
+	pem     []byte
+	jwks    string
+}
+
+func newJWTKeys(t *testing.T) *jwtKeys {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "netick-jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := &jwtKeys{
+		dir:     dir,
+		rsa:     key,
+		pemFile: filepath.Join(dir, "jwt.pem"),
+		pem:     pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}),
+		jwks:    filepath.Join(dir, "jwks.json"),
+	}
+	if err := ioutil.WriteFile(k.pemFile, k.pem, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	b64 := base64.RawURLEncoding.EncodeToString
+	set := map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kid": "rsa",
+				"kty": "RSA",
+				"n":   b64(key.PublicKey.N.Bytes()),
+				"e":   b64(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+			},
+			{
+				"kid": "oct",
+				"kty": "oct",
+				"k":   b64([]byte(testSecret)),
+			},
+		},
+	}
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(k.jwks, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func signToken(t *testing.T, method jwt.SigningMethod, kid string, claims jwt.MapClaims, key interface{}) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	keys := newJWTKeys(t)
+	defer os.RemoveAll(keys.dir)
+
+	now := time.Now()
+	valid := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"sub": "alice",
+			"iss": "https://app.example.com",
+			"aud": "netick",
+			"exp": now.Add(time.Hour).Unix(),
+		}
+	}
+	with := func(key string, value interface{}) jwt.MapClaims {
+		claims := valid()
+		if value == nil {
+			delete(claims, key)
+		} else {
+			claims[key] = value
+		}
+		return claims
+	}
+
+	hs256 := &JWTOptions{
+		Algorithms: []string{"HS256"},
+		Secret:     testSecret,
+		Issuer:     "https://app.example.com",
+		Audience:   "netick",
+		Leeway:     30 * time.Second,
+	}
+	rs256 := &JWTOptions{
+		Algorithms:    []string{"HS256", "RS256"},
+		PublicKeyFile: keys.pemFile,
+	}
+	jwks := &JWTOptions{
+		Algorithms: []string{"HS256", "RS256"},
+		JWKSFile:   keys.jwks,
+	}
+
+	tests := []struct {
+		name  string
+		opts  *JWTOptions
+		token string
+		ok    bool
+	}{
+		{
+			name:  "valid HS256",
+			opts:  hs256,
+			token: signToken(t, jwt.SigningMethodHS256, "", valid(), []byte(testSecret)),
+			ok:    true,
+		},
+		{
+			name:  "wrong secret",
+			opts:  hs256,
+			token: signToken(t, jwt.SigningMethodHS256, "", valid(), []byte("guessed")),
+		},
+		{
+			name:  "alg none",
+			opts:  hs256,
+			token: signToken(t, jwt.SigningMethodNone, "", valid(), jwt.UnsafeAllowNoneSignatureType),
+		},
+		{
+			name:  "algorithm not allowed",
+			opts:  hs256,
+			token: signToken(t, jwt.SigningMethodRS256, "", valid(), keys.rsa),
+		},
+		{
+			name:  "expired within leeway",
+			opts:  hs256,
+			token: signToken(t, jwt.SigningMethodHS256, "", with("exp", now.Add(-10*time.Second).Unix()), []byte(testSecret)),
+			ok:    true,
+		},
+		{
+			name:  "expired beyond leeway",
+			opts:  hs256,
+			token: signToken(t, jwt.SigningMethodHS256, "", with("exp", now.Add(-time.Minute).Unix()), []byte(testSecret)),
+		},
+		{
+			name:  "not valid yet within leeway",
+			opts:  hs256,
+			token: signToken(t, jwt.SigningMethodHS256, "", with("nbf", now.Add(10*time.Second).Unix()), []byte(testSecret)),
+			ok:    true,
+		},
+		{
+			name:  "not valid yet beyond leeway",
+			opts:  hs256,
+			token: signToken(t, jwt.SigningMethodHS256, "", with("nbf", now.Add(time.Minute).Unix()), []byte(testSecret)),
+		},
+		{
+			name:  "missing exp",
+			opts:  hs256,
+			token: signToken(t, jwt.SigningMethodHS256, "", with("exp", nil), []byte(testSecret)),
+		},
+		{
+			name:  "wrong issuer",
+			opts:  hs256,
+			token: signToken(t, jwt.SigningMethodHS256, "", with("iss", "https://evil.example.com"), []byte(testSecret)),
+		},
+		{
+			name:  "missing issuer",
+			opts:  hs256,
+			token: signToken(t, jwt.SigningMethodHS256, "", with("iss", nil), []byte(testSecret)),
+		},
+		{
+			name:  "wrong audience",
+			opts:  hs256,
+			token: signToken(t, jwt.SigningMethodHS256, "", with("aud", "other"), []byte(testSecret)),
+		},
+		{
+			name:  "missing identity",
+			opts:  hs256,
+			token: signToken(t, jwt.SigningMethodHS256, "", with("sub", nil), []byte(testSecret)),
+		},
+		{
+			name:  "invalid permissions",
+			opts:  hs256,
+			token: signToken(t, jwt.SigningMethodHS256, "", with("permissions", "all"), []byte(testSecret)),
+		},
+		{
+			name:  "valid RS256",
+			opts:  rs256,
+			token: signToken(t, jwt.SigningMethodRS256, "", valid(), keys.rsa),
+			ok:    true,
+		},
+		{
+			name:  "public key as HS256 secret",
+			opts:  rs256,
+			token: signToken(t, jwt.SigningMethodHS256, "", valid(), keys.pem),
+		},
+		{
+			name:  "valid JWKS RS256",
+			opts:  jwks,
+			token: signToken(t, jwt.SigningMethodRS256, "rsa", valid(), keys.rsa),
+			ok:    true,
+		},
+		{
+			name:  "valid JWKS HS256",
+			opts:  jwks,
+			token: signToken(t, jwt.SigningMethodHS256, "oct", valid(), []byte(testSecret)),
+			ok:    true,
+		},
+		{
+			name:  "JWKS public key as HS256 secret",
+			opts:  jwks,
+			token: signToken(t, jwt.SigningMethodHS256, "rsa", valid(), keys.pem),
+		},
+		{
+			name:  "JWKS unknown kid",
+			opts:  jwks,
+			token: signToken(t, jwt.SigningMethodRS256, "rotated", valid(), keys.rsa),
+		},
+		{
+			name:  "JWKS without kid",
+			opts:  jwks,
+			token: signToken(t, jwt.SigningMethodRS256, "", valid(), keys.rsa),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := NewJWTAuthenticator(tt.opts)
+			if err != nil {
+				t.Fatalf("NewJWTAuthenticator: %s", err.Error())
+			}
+			id, err := a.Authenticate(&testConn{}, &pb.AuthReq{Token: tt.token})
+			if !tt.ok {
+				if err == nil {
+					t.Fatalf("Authenticate accepted the token as %q", id.Name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Authenticate: %s", err.Error())
+			}
+			if id.Name != "alice" || !id.Stable {
+				t.Fatalf("Authenticate = %+v, want the stable identity alice", id)
+			}
+		})
+	}
+}
+
+func TestJWTAuthenticatorPermissions(t *testing.T) {
+	a, err := NewJWTAuthenticator(&JWTOptions{Algorithms: []string{"HS256"}, Secret: testSecret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := signToken(t, jwt.SigningMethodHS256, "", jwt.MapClaims{
+		"sub": "alice",
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"permissions": map[string]interface{}{
+			"publish":   []string{"orders.>"},
+			"subscribe": []string{"prices.*"},
+		},
+	}, []byte(testSecret))
+
+	id, err := a.Authenticate(&testConn{}, &pb.AuthReq{Token: token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Permissions == nil {
+		t.Fatal("Authenticate returned no permissions")
+	}
+	if !id.Permissions.CanPublish("orders.new") || id.Permissions.CanPublish("prices.eur") {
+		t.Fatal("publish permissions not taken from the claim")
+	}
+	if !id.Permissions.CanSubscribe("prices.eur") || id.Permissions.CanSubscribe("orders.new") {
+		t.Fatal("subscribe permissions not taken from the claim")
+	}
+}
+
+func TestNewJWTAuthenticator(t *testing.T) {
+	tests := []struct {
+		name string
+		opts *JWTOptions
+	}{
+		{name: "no algorithm", opts: &JWTOptions{Secret: testSecret}},
+		{name: "unsupported algorithm", opts: &JWTOptions{Algorithms: []string{"none"}, Secret: testSecret}},
+		{name: "no key", opts: &JWTOptions{Algorithms: []string{"HS256"}}},
+		{name: "missing public key file", opts: &JWTOptions{Algorithms: []string{"RS256"}, PublicKeyFile: "/nonexistent.pem"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewJWTAuthenticator(tt.opts); err == nil {
+				t.Fatal("NewJWTAuthenticator succeeded")
+			}
+		})
+	}
+}
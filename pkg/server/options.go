@@ -1,23 +1,187 @@
 package server
 
-import "time"
+import (
+	"compress/flate"
+	"time"
+)
 
 type Options struct {
 	Websocket       *WebsocketOptions
+	TCP             *TCPOptions
 	PingInterval    time.Duration
 	MaxPingOutTimes int
+	MaxFrameSize    int
 	Auth            *AuthOptions
+	Shutdown        *ShutdownOptions
+	Compression     *CompressionOptions
+	Batch           *BatchOptions
+	SlowConsumer    *SlowConsumerOptions
+	History         *HistoryOptions
+	Retain          *RetainOptions
+	Durable         *DurableOptions
+	Session         *SessionOptions
 }
 
 type AuthOptions struct {
 	Timeout  time.Duration
 	Password string
+	// Authenticator validates AuthReq, nil falls back to a
+	// PasswordAuthenticator checking Password.
+	Authenticator Authenticator
+	// Permissions by identity name, identities not listed get
+	// DefaultPermissions. Both nil allows everything.
+	Permissions        map[string]*Permissions
+	DefaultPermissions *Permissions
+}
+
+func (o *AuthOptions) permissions(identity *Identity) *Permissions {
+	if identity.Permissions != nil {
+		return identity.Permissions
+	}
+	if p, ok := o.Permissions[identity.Name]; ok {
+		return p
+	}
+	return o.DefaultPermissions
+}
+
+func (o *AuthOptions) authenticator() Authenticator {
+	if o.Authenticator != nil {
+		return o.Authenticator
+	}
+	return &PasswordAuthenticator{Password: o.Password}
 }
 
 type WebsocketOptions struct {
 	Addr         string
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
+	TLS          *TLSOptions
+	// AppPing sends opcode level pings instead of websocket control frames,
+	// for clients behind proxies that strip them.
+	AppPing bool
+}
+
+type TCPOptions struct {
+	Addr string
+	TLS  *TLSOptions
+}
+
+// TLSOptions enables TLS on a listener, nil serves plaintext.
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+	// CAFile is used to verify client certificates.
+	CAFile string
+	// Verify requires clients to present a certificate signed by CAFile.
+	Verify bool
+}
+
+type ShutdownOptions struct {
+	// Timeout bounds how long clients are given to receive their queued
+	// frames before the connections are closed.
+	Timeout time.Duration
+	// ReconnectAfter is the hint sent to clients in the GoAway frame.
+	ReconnectAfter time.Duration
+}
+
+// CompressionOptions controls compression of outgoing frames, websocket
+// clients negotiate permessage-deflate, TCP clients the FeatureCompression
+// flag in the hello exchange.
+type CompressionOptions struct {
+	// Threshold is the frame size in bytes from which frames are compressed,
+	// 0 disables compression.
+	Threshold int
+	// Level is the flate level of permessage-deflate, it applies to
+	// connections established after it is changed. TCP frames use snappy,
+	// which has no levels.
+	Level int
+}
+
+// BatchOptions controls how the write loops coalesce queued frames, into a
+// batch frame for clients that negotiated FeatureBatching and into a single
+// vectored write for the other TCP clients.
+type BatchOptions struct {
+	// MaxSize bounds the bytes coalesced into one write, 0 disables
+	// coalescing.
+	MaxSize int
+	// Linger is how long a write waits for more frames once one is queued,
+	// 0 only coalesces the frames already queued.
+	Linger time.Duration
+}
+
+// SlowConsumerOptions bounds the send queue of every connection and sets
+// what happens to frames written to a full one.
+type SlowConsumerOptions struct {
+	// MaxMessages and MaxBytes bound the frames queued per connection, 0 is
+	// unbounded.
+	MaxMessages int
+	MaxBytes    int
+	// Policy applies to frames not covered by Topics.
+	Policy SlowConsumerPolicy
+	// BlockTimeout bounds the wait of the Block policy, counted from the
+	// publish of a message for its publisher and all of its subscribers.
+	BlockTimeout time.Duration
+	// Topics overrides Policy for messages, the first pattern matching the
+	// subject of a message applies.
+	Topics []*TopicPolicy
+}
+
+type TopicPolicy struct {
+	Subject string
+	Policy  SlowConsumerPolicy
+}
+
+// policy returns the policy for messages published to subject.
+func (o *SlowConsumerOptions) policy(subject string) SlowConsumerPolicy {
+	for _, tp := range o.Topics {
+		if subjectCovers(tp.Subject, subject) {
+			return tp.Policy
+		}
+	}
+	return o.Policy
+}
+
+// HistoryOptions bounds the messages kept per subject for replay, the
+// messages beyond any of the bounds are dropped, oldest first.
+type HistoryOptions struct {
+	// MaxMessages per subject, 0 disables history.
+	MaxMessages int
+	// MaxBytes of payload per subject, 0 is unbounded.
+	MaxBytes int
+	// MaxAge of the messages, 0 is unbounded. Subjects whose messages all
+	// expired are dropped.
+	MaxAge time.Duration
+}
+
+type RetainOptions struct {
+	// KeepWithoutSubscribers keeps retained values once the last subscription
+	// to their subject is gone, otherwise they are dropped with it. Values
+	// published before the first subscription are always kept.
+	KeepWithoutSubscribers bool
+}
+
+// DurableOptions bounds the messages a durable subscription keeps until they
+// are acknowledged, beyond the bounds the oldest are dropped.
+type DurableOptions struct {
+	// MaxPending messages per durable, 0 is unbounded.
+	MaxPending int
+	// MaxPendingBytes of payload per durable, 0 is unbounded.
+	MaxPendingBytes int
+	// Expire removes a durable nobody was attached to for this long, 0 keeps
+	// it until it is deleted.
+	Expire time.Duration
+}
+
+// SessionOptions controls the resumption of sessions whose connection was
+// lost, for clients that negotiated the resume feature.
+type SessionOptions struct {
+	// Grace keeps a suspended session, 0 disables resumption.
+	Grace time.Duration
+	// MaxBuffered messages while suspended, the oldest are dropped beyond,
+	// 0 is unbounded.
+	MaxBuffered int
+	// MaxBufferedBytes of payload while suspended, 0 is unbounded.
+	MaxBufferedBytes int
 }
 
 func NewOptions() *Options {
@@ -26,14 +190,128 @@ func NewOptions() *Options {
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 5 * time.Second,
 	}
+	tcp := &TCPOptions{
+		Addr: "0.0.0.0:2635",
+	}
 	auth := &AuthOptions{
-		Timeout:  10 * time.Second,
-		Password: "123456",
+		Timeout: 10 * time.Second,
+	}
+	shutdown := &ShutdownOptions{
+		Timeout:        10 * time.Second,
+		ReconnectAfter: 1 * time.Second,
+	}
+	compression := &CompressionOptions{
+		Threshold: 1024,
+		Level:     flate.BestSpeed,
+	}
+	batch := &BatchOptions{
+		MaxSize: 64 * 1024,
+	}
+	slowConsumer := &SlowConsumerOptions{
+		MaxMessages:  1024,
+		MaxBytes:     8 * 1024 * 1024,
+		Policy:       DropNewest,
+		BlockTimeout: 100 * time.Millisecond,
+	}
+	durable := &DurableOptions{
+		MaxPending:      1024,
+		MaxPendingBytes: 8 * 1024 * 1024,
+		Expire:          24 * time.Hour,
+	}
+	session := &SessionOptions{
+		Grace:            30 * time.Second,
+		MaxBuffered:      1024,
+		MaxBufferedBytes: 1024 * 1024,
+	}
+	history := &HistoryOptions{
+		MaxBytes: 1024 * 1024,
+		MaxAge:   time.Hour,
 	}
 	return &Options{
 		Websocket:       ws,
+		TCP:             tcp,
 		PingInterval:    30 * time.Second,
 		MaxPingOutTimes: 3,
+		MaxFrameSize:    1024 * 1024,
 		Auth:            auth,
+		Shutdown:        shutdown,
+		Compression:     compression,
+		Batch:           batch,
+		SlowConsumer:    slowConsumer,
+		History:         history,
+		Retain:          &RetainOptions{},
+		Durable:         durable,
+		Session:         session,
+	}
+}
+
+// Clone returns a deep copy, options handed to a running server must not be
+// modified in place.
+func (o *Options) Clone() *Options {
+	c := *o
+	if o.Websocket != nil {
+		ws := *o.Websocket
+		ws.TLS = o.Websocket.TLS.clone()
+		c.Websocket = &ws
+	}
+	if o.TCP != nil {
+		tcp := *o.TCP
+		tcp.TLS = o.TCP.TLS.clone()
+		c.TCP = &tcp
+	}
+	if o.Auth != nil {
+		auth := *o.Auth
+		c.Auth = &auth
+	}
+	if o.Shutdown != nil {
+		shutdown := *o.Shutdown
+		c.Shutdown = &shutdown
+	}
+	if o.Compression != nil {
+		compression := *o.Compression
+		c.Compression = &compression
+	}
+	if o.Batch != nil {
+		batch := *o.Batch
+		c.Batch = &batch
+	}
+	if o.SlowConsumer != nil {
+		slowConsumer := *o.SlowConsumer
+		c.SlowConsumer = &slowConsumer
+	}
+	if o.History != nil {
+		history := *o.History
+		c.History = &history
+	}
+	if o.Retain != nil {
+		retain := *o.Retain
+		c.Retain = &retain
+	}
+	if o.Durable != nil {
+		durable := *o.Durable
+		c.Durable = &durable
+	}
+	if o.Session != nil {
+		session := *o.Session
+		c.Session = &session
+	}
+	return &c
+}
+
+// Configure applies the options shared by every server, history, retained
+// values, durables and sessions. It is called before Restore and the servers
+// start, then again on every reload.
+func Configure(opts *Options) {
+	history.configure(opts.History)
+	retained.configure(opts.Retain)
+	durables.configure(opts.Durable)
+	sessions.configure(opts.Session)
+}
+
+func (o *TLSOptions) clone() *TLSOptions {
+	if o == nil {
+		return nil
 	}
+	c := *o
+	return &c
 }
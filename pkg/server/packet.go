@@ -9,8 +9,14 @@ import (
 	"google.golang.org/protobuf/proto"
 )
 
+// Packet is the protobuf codec, a frame is the one byte opcode followed by
+// the protobuf encoded message.
 type Packet struct{}
 
+func (*Packet) Name() string {
+	return CodecProto
+}
+
 func (*Packet) Marshal(code types.OpCode, payload interface{}) ([]byte, error) {
 	pack, ok := payload.(proto.Message)
 	if !ok {
@@ -25,25 +31,32 @@ func (*Packet) Marshal(code types.OpCode, payload interface{}) ([]byte, error) {
 }
 
 func (*Packet) Unmarshal(payload []byte) (types.OpCode, interface{}, error) {
-	if len(payload) < 2 {
-		return types.OpUnknown, nil, fmt.Errorf("Packet.Unmarshal failed: unknown OpCode")
+	if len(payload) < 1 {
+		return types.OpUnknown, nil, fmt.Errorf("Packet.Unmarshal failed: empty packet")
 	}
 	opCode := types.OpCode(payload[0])
 
-	var (
-		unpack interface{}
-		err    error
-	)
-
-	switch opCode {
-	case types.OpAuth:
-		unpack = &pb.AuthReq{}
-		err = proto.Unmarshal(payload[1:], unpack.(*pb.AuthReq))
-	case types.OpSubscribe:
-		unpack = &pb.SubscribeReq{}
-		err = proto.Unmarshal(payload[1:], unpack.(*pb.SubscribeReq))
+	newMsg, ok := requestTypes[opCode]
+	if !ok {
+		return opCode, nil, nil
 	}
+	unpack := newMsg()
+	err := proto.Unmarshal(payload[1:], unpack)
 	return opCode, unpack, err
 }
 
+// requestTypes maps the opcodes a client may send to their message.
+var requestTypes = map[types.OpCode]func() proto.Message{
+	types.OpPing:        func() proto.Message { return &pb.Ping{} },
+	types.OpPong:        func() proto.Message { return &pb.Pong{} },
+	types.OpHello:       func() proto.Message { return &pb.HelloReq{} },
+	types.OpAuth:        func() proto.Message { return &pb.AuthReq{} },
+	types.OpSubscribe:   func() proto.Message { return &pb.SubscribeReq{} },
+	types.OpUnsubscribe: func() proto.Message { return &pb.UnsubscribeReq{} },
+	types.OpPublish:     func() proto.Message { return &pb.PublishReq{} },
+	types.OpBatch:       func() proto.Message { return &pb.Batch{} },
+	types.OpMessageAck:  func() proto.Message { return &pb.MessageAck{} },
+	types.OpResume:      func() proto.Message { return &pb.ResumeReq{} },
+}
+
 var packet = &Packet{}
@@ -0,0 +1,74 @@
+package server
+
+import "fmt"
+
+// Permissions lists the subject patterns an identity may publish and
+// subscribe to, the wildcards of subscriptions apply. A nil *Permissions
+// allows everything.
+type Permissions struct {
+	Publish   []string
+	Subscribe []string
+}
+
+func NewPermissions(publish, subscribe []string) (*Permissions, error) {
+	for _, p := range append(append([]string{}, publish...), subscribe...) {
+		if !ValidSubscribeSubject(p) {
+			return nil, fmt.Errorf("NewPermissions: invalid subject pattern %q", p)
+		}
+	}
+	return &Permissions{
+		Publish:   publish,
+		Subscribe: subscribe,
+	}, nil
+}
+
+func (p *Permissions) CanPublish(subject string) bool {
+	if p == nil {
+		return true
+	}
+	return anyCovers(p.Publish, subject)
+}
+
+// CanSubscribe reports whether every subject matched by the subscription
+// subject is allowed, so "orders.*" is refused when only "orders.eu" is.
+func (p *Permissions) CanSubscribe(subject string) bool {
+	if p == nil {
+		return true
+	}
+	return anyCovers(p.Subscribe, subject)
+}
+
+func anyCovers(patterns []string, subject string) bool {
+	for _, pattern := range patterns {
+		if subjectCovers(pattern, subject) {
+			return true
+		}
+	}
+	return false
+}
+
+// subjectCovers reports whether all subjects matched by subject are also
+// matched by pattern.
+func subjectCovers(pattern, subject string) bool {
+	pts := tokenizeSubject(pattern)
+	sts := tokenizeSubject(subject)
+
+	for i, pt := range pts {
+		if isFwc(pt) {
+			return len(sts) > i
+		}
+		if i >= len(sts) {
+			return false
+		}
+		st := sts[i]
+		switch {
+		case isPwc(pt):
+			if isFwc(st) {
+				return false
+			}
+		case pt != st:
+			return false
+		}
+	}
+	return len(pts) == len(sts)
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/netraitcorp/netick/pb"
+	"github.com/netraitcorp/netick/pkg/types"
+)
+
+type pingt struct {
+	lastp time.Time
+	rtt   time.Duration
+	timer *time.Timer
+	mu    sync.Mutex
+}
+
+func (p *pingt) seen(rtt time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.lastp = time.Now()
+	if rtt > 0 {
+		p.rtt = rtt
+	}
+}
+
+func (p *pingt) roundTrip() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.rtt
+}
+
+// timedOut reports whether the peer has shown no sign of life for
+// MaxPingOutTimes ping intervals.
+func (p *pingt) timedOut(opts *Options) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	d := opts.PingInterval * time.Duration(opts.MaxPingOutTimes)
+	return p.lastp.Before(time.Now().Add(-d))
+}
+
+func (p *pingt) schedule(d time.Duration, f func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.timer = time.AfterFunc(d, f)
+}
+
+func (p *pingt) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+}
+
+func pingFrame(codec Codec) ([]byte, error) {
+	return codec.Marshal(types.OpPing, &pb.Ping{
+		Timestamp: time.Now().UnixNano(),
+	})
+}
+
+// sinceTimestamp converts the timestamp echoed by a pong to a round trip
+// time, zero when the timestamp is missing or bogus.
+func sinceTimestamp(ts int64) time.Duration {
+	if ts <= 0 {
+		return 0
+	}
+	rtt := time.Since(time.Unix(0, ts))
+	if rtt < 0 {
+		return 0
+	}
+	return rtt
+}
@@ -0,0 +1,343 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/netraitcorp/netick/pb"
+	"github.com/netraitcorp/netick/pkg/log"
+	"github.com/netraitcorp/netick/pkg/metrics"
+	"github.com/netraitcorp/netick/pkg/types"
+)
+
+// SlowConsumerPolicy decides what happens to a frame written to a connection
+// whose send queue is full.
+type SlowConsumerPolicy int
+
+const (
+	// DropNewest discards the frame being written.
+	DropNewest SlowConsumerPolicy = iota
+	// DropOldest discards queued frames until the new one fits.
+	DropOldest
+	// Disconnect closes the connection with an ERR_SLOW_CONSUMER frame.
+	Disconnect
+	// Block waits for room in the queue until the deadline of the message,
+	// the block timeout from its publish on, then drops the frame. The
+	// publisher waits for the fan-out of its message up to the same deadline,
+	// shared by every slow subscriber, and later messages of the topic are
+	// held meanwhile.
+	Block
+)
+
+var slowConsumerPolicyNames = map[SlowConsumerPolicy]string{
+	DropNewest: "drop_newest",
+	DropOldest: "drop_oldest",
+	Disconnect: "disconnect",
+	Block:      "block",
+}
+
+func (p SlowConsumerPolicy) String() string {
+	if name, ok := slowConsumerPolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("SlowConsumerPolicy(%d)", int(p))
+}
+
+// ParseSlowConsumerPolicy converts the textual policy used in the
+// configuration file.
+func ParseSlowConsumerPolicy(s string) (SlowConsumerPolicy, error) {
+	for p, name := range slowConsumerPolicyNames {
+		if name == s {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown slow consumer policy %q, expected drop_newest, drop_oldest, disconnect or block", s)
+}
+
+// SlowConsumerStats counts the frames of a connection lost to, or delayed
+// by, the slow consumer policy. The totals of all connections are metrics.
+type SlowConsumerStats struct {
+	Dropped      uint64
+	DroppedBytes uint64
+	// Blocked counts the writes that waited for room under the Block policy.
+	Blocked uint64
+}
+
+func (s *SlowConsumerStats) load() SlowConsumerStats {
+	return SlowConsumerStats{
+		Dropped:      atomic.LoadUint64(&s.Dropped),
+		DroppedBytes: atomic.LoadUint64(&s.DroppedBytes),
+		Blocked:      atomic.LoadUint64(&s.Blocked),
+	}
+}
+
+func (s *SlowConsumerStats) drop(n int, size int) {
+	atomic.AddUint64(&s.Dropped, uint64(n))
+	atomic.AddUint64(&s.DroppedBytes, uint64(size))
+}
+
+var errSlowConsumer = fmt.Errorf("slow consumer")
+
+// blockDeadline returns the deadline the publisher of a message to subject
+// waits for its fan-out until, zero unless the Block policy applies.
+func blockDeadline(opts *SlowConsumerOptions, subject string) time.Time {
+	if opts.policy(subject) != Block {
+		return time.Time{}
+	}
+	return time.Now().Add(opts.BlockTimeout)
+}
+
+// backlogDeadline bounds the Block policy for a backlog sent at once, such
+// as the pending messages of a durable, by a single block timeout rather than
+// one per message.
+func backlogDeadline(opts *SlowConsumerOptions) time.Time {
+	return time.Now().Add(opts.BlockTimeout)
+}
+
+// sendQueue holds the frames written to a connection until its write loop
+// sends them, bounded by the slow consumer options.
+type sendQueue struct {
+	cid      string
+	mu       sync.Mutex
+	frames   [][]byte
+	size     int
+	inflight int
+	// ready is signaled when frames are queued.
+	ready chan struct{}
+	// space is closed, and renewed, when frames are taken off the queue.
+	space  chan struct{}
+	slow   bool
+	closed bool
+	stats  SlowConsumerStats
+}
+
+func newSendQueue(cid string) *sendQueue {
+	return &sendQueue{
+		cid:   cid,
+		ready: make(chan struct{}, 1),
+		space: make(chan struct{}),
+	}
+}
+
+// push queues data, applying policy when the queue is full. deadline bounds
+// the wait of the Block policy, zero waits up to the block timeout.
+func (q *sendQueue) push(data []byte, opts *SlowConsumerOptions, policy SlowConsumerPolicy, deadline time.Time) error {
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	for {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			return fmt.Errorf("sendQueue.push: queue closed, cid: %s", q.cid)
+		}
+		if q.fits(len(data), opts) {
+			q.append(data)
+			q.mu.Unlock()
+			return nil
+		}
+
+		switch policy {
+		case DropOldest:
+			for len(q.frames) > 0 && !q.fits(len(data), opts) {
+				q.size -= len(q.frames[0])
+				q.drop(1, len(q.frames[0]))
+				q.frames[0] = nil
+				q.frames = q.frames[1:]
+			}
+			q.append(data)
+			q.mu.Unlock()
+			return nil
+		case Disconnect:
+			q.mu.Unlock()
+			return errSlowConsumer
+		case Block:
+			if timer == nil {
+				if deadline.IsZero() {
+					deadline = time.Now().Add(opts.BlockTimeout)
+				}
+				timer = time.NewTimer(time.Until(deadline))
+				atomic.AddUint64(&q.stats.Blocked, 1)
+				metrics.BlockedWrites.Inc()
+			}
+			space := q.space
+			q.mu.Unlock()
+
+			select {
+			case <-space:
+				continue
+			case <-timer.C:
+			}
+			q.mu.Lock()
+		}
+
+		q.drop(1, len(data))
+		q.mu.Unlock()
+		return nil
+	}
+}
+
+// fits tells whether a frame of n bytes can be queued, a frame larger than
+// MaxBytes is let through an empty queue.
+func (q *sendQueue) fits(n int, opts *SlowConsumerOptions) bool {
+	if opts.MaxMessages > 0 && len(q.frames) >= opts.MaxMessages {
+		return false
+	}
+	return opts.MaxBytes <= 0 || len(q.frames) == 0 || q.size+n <= opts.MaxBytes
+}
+
+func (q *sendQueue) append(data []byte) {
+	q.frames = append(q.frames, data)
+	q.size += len(data)
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// drop records n lost frames of size bytes in total.
+func (q *sendQueue) drop(n int, size int) {
+	q.stats.drop(n, size)
+	metrics.Dropped.Add(float64(n))
+	metrics.DroppedBytes.Add(float64(size))
+	if !q.slow {
+		q.slow = true
+		log.Warn("sendQueue: slow consumer, dropping frames, cid: %s, queued: %d, bytes: %d", q.cid, len(q.frames), q.size)
+	}
+}
+
+// force queues data regardless of the limits.
+func (q *sendQueue) force(data []byte) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.append(data)
+}
+
+// reset discards the queued frames.
+func (q *sendQueue) reset() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.frames) > 0 {
+		q.drop(len(q.frames), q.size)
+	}
+	q.frames = nil
+	q.size = 0
+	q.release()
+}
+
+// take removes queued frames up to maxSize bytes, at least one when any is
+// queued. They count as buffered until written is called.
+func (q *sendQueue) take(maxSize int) [][]byte {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n, size := 0, 0
+	for n < len(q.frames) {
+		if n > 0 && size+len(q.frames[n]) > maxSize {
+			break
+		}
+		size += len(q.frames[n])
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+
+	frames := make([][]byte, n)
+	copy(frames, q.frames)
+	for i := 0; i < n; i++ {
+		q.frames[i] = nil
+	}
+	q.frames = q.frames[n:]
+	q.size -= size
+	q.inflight += n
+
+	if len(q.frames) > 0 {
+		select {
+		case q.ready <- struct{}{}:
+		default:
+		}
+	} else {
+		q.slow = false
+	}
+	q.release()
+	return frames
+}
+
+// release wakes up the writes blocked on a full queue.
+func (q *sendQueue) release() {
+	close(q.space)
+	q.space = make(chan struct{})
+}
+
+// written reports n frames returned by take as sent.
+func (q *sendQueue) written(n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.inflight -= n
+}
+
+func (q *sendQueue) buffered() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.frames) + q.inflight
+}
+
+// drain removes and returns the queued frames.
+func (q *sendQueue) drain() [][]byte {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	frames := q.frames
+	q.frames = nil
+	q.size = 0
+	q.release()
+	return frames
+}
+
+func (q *sendQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return
+	}
+	q.closed = true
+	q.release()
+}
+
+func (q *sendQueue) slowConsumer() SlowConsumerStats {
+	return q.stats.load()
+}
+
+// enqueue queues data on the send queue of c, a connection found slow under
+// the Disconnect policy is closed with an ERR_SLOW_CONSUMER frame.
+func enqueue(c Conn, q *sendQueue, data []byte, policy SlowConsumerPolicy, deadline time.Time) error {
+	err := q.push(data, c.Server().Options().SlowConsumer, policy, deadline)
+	if err != errSlowConsumer {
+		return err
+	}
+
+	metrics.SlowConsumerDisconnects.Inc()
+	log.Warn("enqueue: slow consumer disconnected, cid: %s", c.ConnID())
+
+	q.reset()
+	e := newError(pb.ErrorCode_ERR_SLOW_CONSUMER, 0, "send queue full")
+	if frame, err := c.Codec().Marshal(types.OpError, e.resp()); err == nil {
+		q.force(frame)
+	}
+	// nothing is queued after the error frame
+	q.close()
+	go flushAndClose(c)
+	return e
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/netraitcorp/netick/pb"
+	"github.com/netraitcorp/netick/pkg/types"
+	"google.golang.org/protobuf/proto"
+)
+
+// newTestQueue returns a queue holding frames of the sizes given, each
+// filled with its index.
+func newTestQueue(sizes ...int) *sendQueue {
+	q := newSendQueue("queue-test")
+	for i, size := range sizes {
+		q.append(bytes.Repeat([]byte{byte(i)}, size))
+	}
+	return q
+}
+
+func TestSendQueueFits(t *testing.T) {
+	tests := []struct {
+		name   string
+		queued []int
+		size   int
+		opts   SlowConsumerOptions
+		want   bool
+	}{
+		{name: "unbounded", queued: []int{10, 10}, size: 10, want: true},
+		{name: "below max messages", queued: []int{1}, size: 1, opts: SlowConsumerOptions{MaxMessages: 2}, want: true},
+		{name: "max messages", queued: []int{1, 1}, size: 1, opts: SlowConsumerOptions{MaxMessages: 2}, want: false},
+		{name: "within max bytes", queued: []int{4}, size: 6, opts: SlowConsumerOptions{MaxBytes: 10}, want: true},
+		{name: "beyond max bytes", queued: []int{4}, size: 7, opts: SlowConsumerOptions{MaxBytes: 10}, want: false},
+		{name: "oversized frame on an empty queue", size: 11, opts: SlowConsumerOptions{MaxBytes: 10}, want: true},
+		{name: "oversized frame on a queued frame", queued: []int{1}, size: 11, opts: SlowConsumerOptions{MaxBytes: 10}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newTestQueue(tt.queued...)
+			if got := q.fits(tt.size, &tt.opts); got != tt.want {
+				t.Fatalf("fits(%d) = %v, want %v", tt.size, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendQueuePush(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy SlowConsumerPolicy
+		queued []int
+		size   int
+		opts   SlowConsumerOptions
+		// want lists the first byte of the frames left queued, the new frame
+		// is 0xff.
+		want         []byte
+		dropped      uint64
+		droppedBytes uint64
+	}{
+		{
+			name: "drop newest", policy: DropNewest, queued: []int{1, 2}, size: 3,
+			opts: SlowConsumerOptions{MaxMessages: 2},
+			want: []byte{0, 1}, dropped: 1, droppedBytes: 3,
+		},
+		{
+			name: "drop oldest by messages", policy: DropOldest, queued: []int{1, 2}, size: 3,
+			opts: SlowConsumerOptions{MaxMessages: 2},
+			want: []byte{1, 0xff}, dropped: 1, droppedBytes: 1,
+		},
+		{
+			name: "drop oldest by bytes", policy: DropOldest, queued: []int{4, 4, 4}, size: 6,
+			opts: SlowConsumerOptions{MaxBytes: 12},
+			want: []byte{2, 0xff}, dropped: 2, droppedBytes: 8,
+		},
+		{
+			name: "drop oldest for an oversized frame", policy: DropOldest, queued: []int{4, 4}, size: 20,
+			opts: SlowConsumerOptions{MaxBytes: 10},
+			want: []byte{0xff}, dropped: 2, droppedBytes: 8,
+		},
+		{
+			name: "room left", policy: DropNewest, queued: []int{1}, size: 1,
+			opts: SlowConsumerOptions{MaxMessages: 2},
+			want: []byte{0, 0xff},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newTestQueue(tt.queued...)
+			data := bytes.Repeat([]byte{0xff}, tt.size)
+			if err := q.push(data, &tt.opts, tt.policy, time.Time{}); err != nil {
+				t.Fatalf("push: %v", err)
+			}
+
+			var got []byte
+			for _, f := range q.frames {
+				got = append(got, f[0])
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Fatalf("queued frames %v, want %v", got, tt.want)
+			}
+			stats := q.slowConsumer()
+			if stats.Dropped != tt.dropped || stats.DroppedBytes != tt.droppedBytes {
+				t.Fatalf("dropped %d frames, %d bytes, want %d, %d", stats.Dropped, stats.DroppedBytes, tt.dropped, tt.droppedBytes)
+			}
+		})
+	}
+}
+
+func TestSendQueueDisconnect(t *testing.T) {
+	opts := NewOptions()
+	opts.SlowConsumer = &SlowConsumerOptions{Policy: Disconnect, MaxMessages: 2}
+	conn := newRecordConn(newTestServer(opts))
+	q := newTestQueue(1, 1)
+
+	err := enqueue(conn, q, []byte{0xff}, Disconnect, time.Time{})
+	if e, ok := err.(*Error); !ok || e.Code != pb.ErrorCode_ERR_SLOW_CONSUMER {
+		t.Fatalf("enqueue returned %v, want an ERR_SLOW_CONSUMER error", err)
+	}
+
+	q.mu.Lock()
+	frames := q.frames
+	closed := q.closed
+	q.mu.Unlock()
+	if len(frames) != 1 || types.OpCode(frames[0][0]) != types.OpError {
+		t.Fatalf("queued %d frames, want the error frame alone", len(frames))
+	}
+	resp := &pb.ErrorResp{}
+	if err := proto.Unmarshal(frames[0][1:], resp); err != nil || resp.Code != pb.ErrorCode_ERR_SLOW_CONSUMER {
+		t.Fatalf("queued %+v, want an ERR_SLOW_CONSUMER frame", resp)
+	}
+	if !closed {
+		t.Fatal("queue still open after the disconnect")
+	}
+	if stats := q.slowConsumer(); stats.Dropped != 2 {
+		t.Fatalf("dropped %d frames, want the 2 reset", stats.Dropped)
+	}
+	if err := q.push([]byte{0xfe}, opts.SlowConsumer, DropNewest, time.Time{}); err == nil {
+		t.Fatal("push succeeded after the disconnect")
+	}
+}
+
+func TestSendQueueBlock(t *testing.T) {
+	opts := &SlowConsumerOptions{MaxMessages: 1, BlockTimeout: time.Minute}
+
+	tests := []struct {
+		name     string
+		deadline time.Duration
+		// take frees room while the write is blocked
+		take   bool
+		queued bool
+	}{
+		{name: "deadline expires", deadline: 20 * time.Millisecond, queued: false},
+		{name: "woken by take", deadline: time.Minute, take: true, queued: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newTestQueue(1)
+			start := time.Now()
+			done := make(chan error, 1)
+			go func() {
+				done <- q.push([]byte{0xff}, opts, Block, start.Add(tt.deadline))
+			}()
+
+			if tt.take {
+				// wait for the write to block before freeing room
+				for q.slowConsumer().Blocked == 0 {
+					time.Sleep(time.Millisecond)
+				}
+				q.take(1)
+			}
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatalf("push: %v", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("blocked write not released")
+			}
+			if !tt.take && time.Since(start) < tt.deadline {
+				t.Fatalf("released after %v, before the deadline %v", time.Since(start), tt.deadline)
+			}
+
+			stats := q.slowConsumer()
+			if stats.Blocked != 1 {
+				t.Fatalf("blocked %d writes, want 1", stats.Blocked)
+			}
+			queued := len(q.frames) == 1 && q.frames[0][0] == 0xff
+			if queued != tt.queued {
+				t.Fatalf("frame queued = %v, want %v", queued, tt.queued)
+			}
+			if dropped := stats.Dropped == 1; dropped == tt.queued {
+				t.Fatalf("dropped %d frames, want the frame dropped = %v", stats.Dropped, !tt.queued)
+			}
+		})
+	}
+}
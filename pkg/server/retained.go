@@ -0,0 +1,125 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/netraitcorp/netick/pb"
+)
+
+// Retained keeps the last message published with retain of every subject.
+type Retained struct {
+	mu       sync.Mutex
+	subjects map[string]*pb.Message
+	opts     atomic.Value
+}
+
+func NewRetained() *Retained {
+	r := &Retained{
+		subjects: make(map[string]*pb.Message),
+	}
+	r.opts.Store(&RetainOptions{})
+	return r
+}
+
+var retained = NewRetained()
+
+func (r *Retained) options() *RetainOptions {
+	return r.opts.Load().(*RetainOptions)
+}
+
+func (r *Retained) configure(opts *RetainOptions) {
+	if opts != nil {
+		r.opts.Store(opts)
+	}
+}
+
+// store replaces the retained value of msg.Name.
+func (r *Retained) store(msg *pb.Message) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.subjects[msg.Name] = &pb.Message{
+		Name:      msg.Name,
+		Data:      msg.Data,
+		Seq:       msg.Seq,
+		Timestamp: msg.Timestamp,
+		Retained:  true,
+	}
+}
+
+// Clear drops the retained value of subject and reports whether there was one.
+func (r *Retained) Clear(subject string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.subjects[subject]; !ok {
+		return false
+	}
+	delete(r.subjects, subject)
+	return true
+}
+
+// match returns the retained values of the subjects matching pattern,
+// ordered by sequence number.
+func (r *Retained) match(pattern string) []*pb.Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var msgs []*pb.Message
+	for subject, msg := range r.subjects {
+		if subjectCovers(pattern, subject) {
+			msgs = append(msgs, msg)
+		}
+	}
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].Seq < msgs[j].Seq
+	})
+	return msgs
+}
+
+// values returns every retained value.
+func (r *Retained) values() []*pb.Message {
+	return r.match(">")
+}
+
+// release drops the retained values matching pattern that no subscription
+// is left for, unless they are kept without subscribers. It returns the
+// subjects dropped.
+func (r *Retained) release(pattern string, subscribed func(subject string) bool) []string {
+	if r.options().KeepWithoutSubscribers {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var released []string
+	for subject := range r.subjects {
+		if subjectCovers(pattern, subject) && !subscribed(subject) {
+			delete(r.subjects, subject)
+			released = append(released, subject)
+		}
+	}
+	return released
+}
+
+// withRetained prepends the retained values to the replayed history, a
+// message found in both is delivered once, as retained value.
+func withRetained(values []*pb.Message, replay []*pb.Message) []*pb.Message {
+	if len(values) == 0 {
+		return replay
+	}
+	seqs := make(map[uint64]bool, len(values))
+	for _, msg := range values {
+		seqs[msg.Seq] = true
+	}
+	msgs := append([]*pb.Message{}, values...)
+	for _, msg := range replay {
+		if !seqs[msg.Seq] {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetainedWithoutSubscribers(t *testing.T) {
+	tests := []struct {
+		name string
+		keep bool
+		// kept after the last subscription is gone
+		kept bool
+	}{
+		{name: "dropped with the last subscription", keep: false, kept: false},
+		{name: "kept without subscribers", keep: true, kept: true},
+	}
+
+	defer retained.configure(retained.options())
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			retained.configure(&RetainOptions{KeepWithoutSubscribers: tt.keep})
+			subject := "retained.price." + t.Name()
+			defer retained.Clear(subject)
+
+			s := NewSubscribe()
+			s.Publish(subject, []byte("42"), true, time.Time{})
+			if n := len(retained.match(subject)); n != 1 {
+				t.Fatalf("got %d retained values before the first subscription, want 1", n)
+			}
+
+			acc, conn := newTestAccount(NewOptions())
+			s.Subscribe(subject, acc, nil)
+			msgs := conn.waitMessages(t, 1)
+			if string(msgs[0].Data) != "42" || !msgs[0].Retained {
+				t.Fatalf("got %+v, want the retained value", msgs[0])
+			}
+
+			s.UnSubscribe(subject, acc)
+			kept := len(retained.match(subject)) == 1
+			if kept != tt.kept {
+				t.Fatalf("retained value kept after the last subscription = %v, want %v", kept, tt.kept)
+			}
+		})
+	}
+}
@@ -2,4 +2,8 @@ package server
 
 type Server interface {
 	Options() *Options
+
+	// Reload swaps the options used by the running server, only the fields
+	// that are read per connection or per operation take effect.
+	Reload(opts *Options)
 }
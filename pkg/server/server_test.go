@@ -0,0 +1,194 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/netraitcorp/netick/pb"
+	"github.com/netraitcorp/netick/pkg/log"
+	"github.com/netraitcorp/netick/pkg/types"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "netick-log")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	opts := log.NewOptions()
+	opts.Filename = filepath.Join(dir, "netick.log")
+	opts.Level = "error"
+	log.Init(opts)
+
+	code := m.Run()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// testServer serves fixed options.
+type testServer struct {
+	opts atomic.Value
+}
+
+func newTestServer(opts *Options) *testServer {
+	srv := &testServer{}
+	srv.opts.Store(opts)
+	return srv
+}
+
+func (srv *testServer) Options() *Options {
+	return srv.opts.Load().(*Options)
+}
+
+func (srv *testServer) Reload(opts *Options) {
+	srv.opts.Store(opts)
+}
+
+var connIDs uint64
+
+// recordConn records the frames sent to it and decodes the messages, the
+// other methods of Conn are not used by the code under test. onSend, if set,
+// is called first by Send, e.g. to stand for a full queue. codec defaults to
+// packet, unsent stands for the frames a lost connection did not send.
+type recordConn struct {
+	Conn
+	id     string
+	srv    Server
+	codec  Codec
+	onSend func(policy SlowConsumerPolicy, deadline time.Time)
+	mu     sync.Mutex
+	frames [][]byte
+	msgs   []*pb.Message
+	unsent [][]byte
+	closed bool
+}
+
+func newRecordConn(srv Server) *recordConn {
+	return &recordConn{
+		id:  fmt.Sprintf("conn-%d", atomic.AddUint64(&connIDs, 1)),
+		srv: srv,
+	}
+}
+
+func (c *recordConn) ConnID() string {
+	return c.id
+}
+
+func (c *recordConn) Server() Server {
+	return c.srv
+}
+
+func (c *recordConn) Codec() Codec {
+	if c.codec != nil {
+		return c.codec
+	}
+	return packet
+}
+
+func (c *recordConn) Write(data []byte) error {
+	return c.Send(data, c.srv.Options().SlowConsumer.Policy, time.Time{})
+}
+
+func (c *recordConn) Send(data []byte, policy SlowConsumerPolicy, deadline time.Time) error {
+	if c.onSend != nil {
+		c.onSend(policy, deadline)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.frames = append(c.frames, data)
+	if c.Codec() != packet || len(data) == 0 || types.OpCode(data[0]) != types.OpMessage {
+		return nil
+	}
+	msg := &pb.Message{}
+	if err := proto.Unmarshal(data[1:], msg); err != nil {
+		return err
+	}
+	c.msgs = append(c.msgs, msg)
+	return nil
+}
+
+// lastFrame decodes into m the last frame sent with opcode op, it reports
+// whether there was one.
+func (c *recordConn) lastFrame(op types.OpCode, m proto.Message) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := len(c.frames) - 1; i >= 0; i-- {
+		if data := c.frames[i]; len(data) > 0 && types.OpCode(data[0]) == op {
+			return proto.Unmarshal(data[1:], m) == nil
+		}
+	}
+	return false
+}
+
+func (c *recordConn) TLSState() *tls.ConnectionState {
+	return nil
+}
+
+func (c *recordConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	return nil
+}
+
+func (c *recordConn) Closed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.closed
+}
+
+func (c *recordConn) Buffered() int {
+	return 0
+}
+
+func (c *recordConn) Unsent() [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	unsent := c.unsent
+	c.unsent = nil
+	return unsent
+}
+
+// messages returns the messages received so far.
+func (c *recordConn) messages() []*pb.Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]*pb.Message{}, c.msgs...)
+}
+
+// waitMessages waits until n messages were received, it fails the test after
+// a second.
+func (c *recordConn) waitMessages(t *testing.T, n int) []*pb.Message {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		msgs := c.messages()
+		if len(msgs) >= n {
+			return msgs
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("received %d messages, want %d", len(msgs), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// newTestAccount returns an account on a recordConn of a server using opts.
+func newTestAccount(opts *Options) (*Account, *recordConn) {
+	conn := newRecordConn(newTestServer(opts))
+	return NewAccount(conn), conn
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/netraitcorp/netick/pkg/log"
+)
+
+// Sessions holds the resumable accounts by resume token. A session whose
+// connection is lost is suspended for the grace period, a ResumeReq with its
+// token reattaches it to the new connection.
+type Sessions struct {
+	mu     sync.Mutex
+	tokens map[string]*Account
+	opts   atomic.Value
+}
+
+func NewSessions() *Sessions {
+	ss := &Sessions{
+		tokens: make(map[string]*Account),
+	}
+	ss.opts.Store(&SessionOptions{})
+	return ss
+}
+
+var sessions = NewSessions()
+
+var ErrSessionNotFound = fmt.Errorf("session not found or expired")
+
+func (ss *Sessions) options() *SessionOptions {
+	return ss.opts.Load().(*SessionOptions)
+}
+
+func (ss *Sessions) configure(opts *SessionOptions) {
+	if opts != nil {
+		ss.opts.Store(opts)
+	}
+}
+
+// newSessionToken returns a random token, it is the only credential needed
+// to resume a session.
+func newSessionToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// open makes acc resumable and returns its token, empty when sessions are
+// disabled.
+func (ss *Sessions) open(acc *Account) (string, error) {
+	if ss.options().Grace <= 0 {
+		return "", nil
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	return ss.rotate(acc)
+}
+
+// rotate replaces the token of acc.
+func (ss *Sessions) rotate(acc *Account) (string, error) {
+	token, err := newSessionToken()
+	if err != nil {
+		return "", fmt.Errorf("Sessions.rotate: %s, cid: %s", err.Error(), acc.ID())
+	}
+	if acc.token != "" {
+		delete(ss.tokens, acc.token)
+	}
+	acc.token = token
+	ss.tokens[token] = acc
+	return token, nil
+}
+
+// suspend keeps acc for the grace period after conn was lost. It returns
+// false when acc is not resumable and must be closed.
+func (ss *Sessions) suspend(acc *Account, conn Conn) bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if acc.Conn() != conn {
+		// resumed on another connection already
+		return true
+	}
+	grace := ss.options().Grace
+	if acc.token == "" || grace <= 0 {
+		ss.forget(acc)
+		return false
+	}
+
+	acc.suspend()
+	acc.expiry = time.AfterFunc(grace, func() {
+		ss.expire(acc, conn)
+	})
+	log.Info("Sessions.suspend: cid: %s, grace: %s", acc.ID(), grace)
+	return true
+}
+
+// expire closes acc unless it was resumed since conn was lost.
+func (ss *Sessions) expire(acc *Account, conn Conn) {
+	ss.mu.Lock()
+	if acc.Conn() != conn || acc.token == "" {
+		ss.mu.Unlock()
+		return
+	}
+	ss.forget(acc)
+	ss.mu.Unlock()
+
+	log.Info("Sessions.expire: cid: %s", acc.ID())
+	closeAccount(acc)
+}
+
+// resume reattaches the session of token to conn. It returns the session,
+// its next token and the connection it had so far.
+func (ss *Sessions) resume(token string, conn Conn) (*Account, string, Conn, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	acc, ok := ss.tokens[token]
+	if !ok {
+		return nil, "", nil, ErrSessionNotFound
+	}
+	next, err := ss.rotate(acc)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if acc.expiry != nil {
+		acc.expiry.Stop()
+		acc.expiry = nil
+	}
+	return acc, next, acc.reattach(conn), nil
+}
+
+// discard makes acc not resumable, a suspended session is closed.
+func (ss *Sessions) discard(acc *Account) {
+	ss.mu.Lock()
+	ss.forget(acc)
+	ss.mu.Unlock()
+
+	if acc.Suspended() {
+		closeAccount(acc)
+	}
+}
+
+func (ss *Sessions) forget(acc *Account) {
+	if acc.token != "" {
+		delete(ss.tokens, acc.token)
+		acc.token = ""
+	}
+	if acc.expiry != nil {
+		acc.expiry.Stop()
+		acc.expiry = nil
+	}
+}
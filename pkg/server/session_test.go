@@ -0,0 +1,326 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/netraitcorp/netick/pb"
+	"github.com/netraitcorp/netick/pkg/types"
+	"github.com/netraitcorp/netick/pkg/util"
+	"google.golang.org/protobuf/proto"
+)
+
+// pipeClient speaks the TCP protocol to a TCPConn over a net.Pipe, the
+// frames received are queued until read by next.
+type pipeClient struct {
+	conn   net.Conn
+	frames chan []byte
+}
+
+func newPipeClient(srv Server) *pipeClient {
+	server, client := net.Pipe()
+	NewTCPConn(server, srv).Accept()
+
+	pc := &pipeClient{
+		conn:   client,
+		frames: make(chan []byte, 64),
+	}
+	go pc.loopRead()
+	return pc
+}
+
+func (pc *pipeClient) loopRead() {
+	defer close(pc.frames)
+
+	head := make([]byte, HeadPackSizeLen)
+	for {
+		if _, err := io.ReadFull(pc.conn, head); err != nil {
+			return
+		}
+		data := make([]byte, binary.BigEndian.Uint32(head))
+		if _, err := io.ReadFull(pc.conn, data); err != nil {
+			return
+		}
+		pc.frames <- data
+	}
+}
+
+func (pc *pipeClient) send(t *testing.T, op types.OpCode, m proto.Message) {
+	t.Helper()
+	data, err := packet.Marshal(op, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, HeadPackSizeLen+len(data))
+	binary.BigEndian.PutUint32(b, uint32(len(data)))
+	copy(b[HeadPackSizeLen:], data)
+	if _, err := pc.conn.Write(b); err != nil {
+		t.Fatalf("send: %s", err.Error())
+	}
+}
+
+// next decodes into m the next frame received, it fails the test unless the
+// frame has opcode op.
+func (pc *pipeClient) next(t *testing.T, op types.OpCode, m proto.Message) {
+	t.Helper()
+	select {
+	case data, ok := <-pc.frames:
+		if !ok {
+			t.Fatalf("connection closed, want opcode 0x%02x", uint8(op))
+		}
+		if types.OpCode(data[0]) != op {
+			t.Fatalf("got opcode 0x%02x, want 0x%02x", data[0], uint8(op))
+		}
+		if err := proto.Unmarshal(data[1:], m); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no frame received, want opcode 0x%02x", uint8(op))
+	}
+}
+
+func (pc *pipeClient) hello(t *testing.T) {
+	t.Helper()
+	pc.send(t, types.OpHello, &pb.HelloReq{Version: types.ProtocolVersion, Features: types.FeatureResume})
+	pc.next(t, types.OpHelloRet, &pb.HelloResp{})
+}
+
+// authorize authenticates a resumable session subscribed to subject.
+func (pc *pipeClient) authorize(t *testing.T, subject string) *pb.AuthResp {
+	t.Helper()
+	pc.hello(t)
+	pc.send(t, types.OpAuth, &pb.AuthReq{Password: util.Sha1(testPassword), Id: 1})
+	resp := &pb.AuthResp{}
+	pc.next(t, types.OpAuthRet, resp)
+	if resp.GetResumeToken() == "" {
+		t.Fatalf("AuthResp %+v, want a resume token", resp)
+	}
+	pc.send(t, types.OpSubscribe, &pb.SubscribeReq{Name: subject, Id: 2})
+	pc.next(t, types.OpAck, &pb.Ack{})
+	return resp
+}
+
+// resume sends a ResumeReq with token on a new connection.
+func (pc *pipeClient) resume(t *testing.T, token string) {
+	t.Helper()
+	pc.hello(t)
+	pc.send(t, types.OpResume, &pb.ResumeReq{Token: token, Id: 3})
+}
+
+func (pc *pipeClient) wantMessage(t *testing.T, data string) {
+	t.Helper()
+	msg := &pb.Message{}
+	pc.next(t, types.OpMessage, msg)
+	if string(msg.Data) != data {
+		t.Fatalf("got message %q, want %q", msg.Data, data)
+	}
+}
+
+func (pc *pipeClient) wantError(t *testing.T, code pb.ErrorCode) {
+	t.Helper()
+	resp := &pb.ErrorResp{}
+	pc.next(t, types.OpError, resp)
+	if resp.Code != code {
+		t.Fatalf("got error %s, want %s", resp.Code, code)
+	}
+}
+
+// waitFor polls cond for up to a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// suspendedAccount loses the connection of pc and returns its session once
+// suspended.
+func suspendedAccount(t *testing.T, pc *pipeClient, id string) *Account {
+	t.Helper()
+	acc, ok := accounts.Account(id)
+	if !ok {
+		t.Fatalf("no account %s", id)
+	}
+	_ = pc.conn.Close()
+	waitFor(t, "the session to be suspended", acc.Suspended)
+	return acc
+}
+
+func accountClosed(id string) func() bool {
+	return func() bool {
+		_, ok := accounts.Account(id)
+		return !ok
+	}
+}
+
+func TestSessionResume(t *testing.T) {
+	defer sessions.configure(sessions.options())
+	opts := handlerOptions()
+	sessions.configure(opts.Session)
+	srv := newTestServer(opts)
+	subject := "session.resume"
+
+	c1 := newPipeClient(srv)
+	auth := c1.authorize(t, subject)
+	acc := suspendedAccount(t, c1, auth.GetConnId())
+	subscribe.Publish(subject, []byte("buffered"), false, time.Time{})
+
+	c2 := newPipeClient(srv)
+	defer func() {
+		suspendedAccount(t, c2, auth.GetConnId())
+		sessions.discard(acc)
+	}()
+	c2.resume(t, auth.GetResumeToken())
+	resp := &pb.AuthResp{}
+	c2.next(t, types.OpAuthRet, resp)
+	if !resp.GetResumed() || resp.GetConnId() != auth.GetConnId() {
+		t.Fatalf("AuthResp %+v, want session %s resumed", resp, auth.GetConnId())
+	}
+	if token := resp.GetResumeToken(); token == "" || token == auth.GetResumeToken() {
+		t.Fatalf("resume token %q, want a new one", token)
+	}
+	c2.wantMessage(t, "buffered")
+
+	subscribe.Publish(subject, []byte("live"), false, time.Time{})
+	c2.wantMessage(t, "live")
+
+	// the token is rotated, the one used is not accepted again
+	c3 := newPipeClient(srv)
+	defer c3.conn.Close()
+	c3.resume(t, auth.GetResumeToken())
+	c3.wantError(t, pb.ErrorCode_ERR_AUTH_FAILED)
+}
+
+func TestSessionExpiry(t *testing.T) {
+	defer sessions.configure(sessions.options())
+	opts := handlerOptions()
+	opts.Session.Grace = 20 * time.Millisecond
+	sessions.configure(opts.Session)
+	srv := newTestServer(opts)
+	subject := "session.expiry"
+
+	c1 := newPipeClient(srv)
+	auth := c1.authorize(t, subject)
+	suspendedAccount(t, c1, auth.GetConnId())
+
+	waitFor(t, "the session to expire", accountClosed(auth.GetConnId()))
+	if _, ok := subscribe.Topic(subject); ok {
+		t.Fatal("subscription of the expired session kept")
+	}
+
+	c2 := newPipeClient(srv)
+	defer c2.conn.Close()
+	c2.resume(t, auth.GetResumeToken())
+	c2.wantError(t, pb.ErrorCode_ERR_AUTH_FAILED)
+}
+
+func TestSessionKick(t *testing.T) {
+	defer sessions.configure(sessions.options())
+	opts := handlerOptions()
+	sessions.configure(opts.Session)
+	srv := newTestServer(opts)
+
+	tests := []struct {
+		name      string
+		suspended bool
+	}{
+		{name: "connected"},
+		{name: "suspended", suspended: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c1 := newPipeClient(srv)
+			auth := c1.authorize(t, "session.kick")
+			if tt.suspended {
+				suspendedAccount(t, c1, auth.GetConnId())
+			}
+
+			if err := Kick(auth.GetConnId(), "maintenance"); err != nil {
+				t.Fatal(err)
+			}
+			if !tt.suspended {
+				goAway := &pb.GoAway{}
+				c1.next(t, types.OpGoAway, goAway)
+				if goAway.GetReason() != "maintenance" {
+					t.Fatalf("GoAway %+v, want the kick reason", goAway)
+				}
+			}
+			waitFor(t, "the session to be closed", accountClosed(auth.GetConnId()))
+
+			c2 := newPipeClient(srv)
+			defer c2.conn.Close()
+			c2.resume(t, auth.GetResumeToken())
+			c2.wantError(t, pb.ErrorCode_ERR_AUTH_FAILED)
+		})
+	}
+}
+
+func TestSessionResumeUnsent(t *testing.T) {
+	defer sessions.configure(sessions.options())
+	opts := handlerOptions()
+	sessions.configure(opts.Session)
+
+	unsent := &pb.Message{Name: "session.unsent", Seq: 1, Data: []byte("unsent")}
+	buffered := &pb.Message{Name: "session.unsent", Seq: 2, Data: []byte("buffered")}
+
+	tests := []struct {
+		name  string
+		codec Codec
+		want  string
+	}{
+		{name: "same codec", codec: packet, want: "unsent buffered"},
+		{name: "codec changed", codec: jsonPacket, want: "buffered"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r1, conn1 := newTestHandler(opts)
+			token := authorizeResumable(t, r1, conn1)
+			acc := r1.acc
+
+			// the lost connection used tt.codec and did not send a frame
+			frame, err := tt.codec.Marshal(types.OpMessage, unsent)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn1.codec = tt.codec
+			conn1.unsent = [][]byte{frame}
+			r1.Close()
+			if err := acc.deliver(buffered, nil, time.Time{}); err != nil {
+				t.Fatal(err)
+			}
+
+			r2, conn2 := newTestHandler(opts)
+			defer sessions.discard(acc)
+			defer r2.Close()
+			if err := r2.dispatch(types.OpResume, &pb.ResumeReq{Token: token, Id: 2}); err != nil {
+				t.Fatalf("resume: %s", err.Error())
+			}
+			if !conn1.Closed() {
+				t.Fatal("lost connection not closed")
+			}
+
+			var got []string
+			for _, msg := range conn2.messages() {
+				got = append(got, string(msg.Data))
+			}
+			if s := fmt.Sprint(got); s != "["+tt.want+"]" {
+				t.Fatalf("got messages %s, want [%s]", s, tt.want)
+			}
+			// nothing else follows the AuthResp
+			conn2.mu.Lock()
+			frames := len(conn2.frames)
+			conn2.mu.Unlock()
+			if frames != 1+len(got) {
+				t.Fatalf("sent %d frames, want the AuthResp and %d messages", frames, len(got))
+			}
+		})
+	}
+}
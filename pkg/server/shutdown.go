@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/netraitcorp/netick/pb"
+	"github.com/netraitcorp/netick/pkg/log"
+	"github.com/netraitcorp/netick/pkg/types"
+)
+
+const drainPollInterval = 50 * time.Millisecond
+
+// DrainConns tells every client the server is going away, waits until their
+// write queues are flushed or ctx is done, then closes all connections and
+// stops the topic goroutines. The listeners must be shut down beforehand so
+// no connection is accepted while draining.
+func DrainConns(ctx context.Context, reconnectAfter time.Duration) {
+	goAway := newFrameCache(types.OpGoAway, &pb.GoAway{
+		Reason:         "server shutting down",
+		ReconnectAfter: uint32(reconnectAfter / time.Millisecond),
+	})
+	accounts.Range(func(acc *Account) bool {
+		if acc.Suspended() {
+			return true
+		}
+		conn := acc.Conn()
+		data, err := goAway.frame(conn.Codec())
+		if err == nil {
+			err = conn.Write(data)
+		}
+		if err != nil {
+			log.Warn("DrainConns: write go away failed, cid: %s, err: %s", acc.ID(), err.Error())
+		}
+		return true
+	})
+
+	if !waitFlushed(ctx) {
+		log.Warn("DrainConns: deadline exceeded, closing connections with pending frames")
+	}
+
+	accounts.Range(func(acc *Account) bool {
+		_ = acc.Conn().Close()
+		return true
+	})
+	subscribe.StopAll()
+}
+
+func waitFlushed(ctx context.Context) bool {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for !flushed() {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+func flushed() bool {
+	done := true
+	accounts.Range(func(acc *Account) bool {
+		if conn := acc.Conn(); conn.Buffered() > 0 && !conn.Closed() {
+			done = false
+		}
+		return done
+	})
+	return done
+}
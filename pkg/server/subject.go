@@ -0,0 +1,75 @@
+package server
+
+import "strings"
+
+const (
+	subjectSeps = "./"
+
+	// single-level wildcards, match exactly one token
+	pwcStar = "*"
+	pwcPlus = "+"
+
+	// multi-level wildcards, match one or more trailing tokens
+	fwcGt   = ">"
+	fwcHash = "#"
+)
+
+func isSubjectSep(r rune) bool {
+	return strings.ContainsRune(subjectSeps, r)
+}
+
+func isPwc(token string) bool {
+	return token == pwcStar || token == pwcPlus
+}
+
+func isFwc(token string) bool {
+	return token == fwcGt || token == fwcHash
+}
+
+// tokenizeSubject splits a subject on both "." and "/", so "orders.eu" and
+// "orders/eu" address the same topic hierarchy.
+func tokenizeSubject(subject string) []string {
+	return strings.FieldsFunc(subject, isSubjectSep)
+}
+
+// validSubject reports whether subject is well formed. Wildcards are only
+// accepted when allowWildcards is set, as a whole token, and the multi-level
+// wildcard only in the last position.
+func validSubject(subject string, allowWildcards bool) bool {
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n") {
+		return false
+	}
+	if isSubjectSep(rune(subject[0])) || isSubjectSep(rune(subject[len(subject)-1])) {
+		return false
+	}
+
+	tokens := tokenizeSubject(subject)
+	// empty tokens ("a..b") are swallowed by FieldsFunc, count separators instead
+	if len(tokens) != strings.Count(subject, ".")+strings.Count(subject, "/")+1 {
+		return false
+	}
+	for i, token := range tokens {
+		wc := isPwc(token) || isFwc(token)
+		if !wc && strings.ContainsAny(token, pwcStar+pwcPlus+fwcGt+fwcHash) {
+			return false
+		}
+		if wc && !allowWildcards {
+			return false
+		}
+		if isFwc(token) && i != len(tokens)-1 {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidSubscribeSubject reports whether subject may be used in a SubscribeReq.
+func ValidSubscribeSubject(subject string) bool {
+	return validSubject(subject, true)
+}
+
+// ValidPublishSubject reports whether subject may be used in a PublishReq,
+// which must always address a concrete topic.
+func ValidPublishSubject(subject string) bool {
+	return validSubject(subject, false)
+}
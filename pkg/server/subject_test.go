@@ -0,0 +1,78 @@
+package server
+
+import "testing"
+
+func TestValidSubject(t *testing.T) {
+	tests := []struct {
+		subject   string
+		subscribe bool
+		publish   bool
+	}{
+		{"a", true, true},
+		{"a.b.c", true, true},
+		{"a/b/c", true, true},
+		{"a.b/c", true, true},
+		{"orders-eu_1", true, true},
+		{"*", true, false},
+		{">", true, false},
+		{"#", true, false},
+		{"a.*", true, false},
+		{"a.+.c", true, false},
+		{"a.>", true, false},
+		{"a/#", true, false},
+		{"*.*.>", true, false},
+		{"", false, false},
+		{".", false, false},
+		{".a", false, false},
+		{"a.", false, false},
+		{"/a", false, false},
+		{"a/", false, false},
+		{"a..b", false, false},
+		{"a./b", false, false},
+		{"a b", false, false},
+		{"a\tb", false, false},
+		{"a.b\n", false, false},
+		{"a.>.b", false, false},
+		{"#.a", false, false},
+		{"a*", false, false},
+		{"a.b*", false, false},
+		{"a.>b", false, false},
+		{"a.+b.c", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.subject, func(t *testing.T) {
+			if got := ValidSubscribeSubject(tt.subject); got != tt.subscribe {
+				t.Errorf("ValidSubscribeSubject(%q) = %v, want %v", tt.subject, got, tt.subscribe)
+			}
+			if got := ValidPublishSubject(tt.subject); got != tt.publish {
+				t.Errorf("ValidPublishSubject(%q) = %v, want %v", tt.subject, got, tt.publish)
+			}
+			if got := validSubject(tt.subject, false); got != tt.publish {
+				t.Errorf("validSubject(%q, false) = %v, want %v", tt.subject, got, tt.publish)
+			}
+		})
+	}
+}
+
+func TestTokenizeSubject(t *testing.T) {
+	tests := []struct {
+		subject string
+		want    []string
+	}{
+		{"a", []string{"a"}},
+		{"a.b.c", []string{"a", "b", "c"}},
+		{"a/b.c", []string{"a", "b", "c"}},
+		{"a.*/#", []string{"a", "*", "#"}},
+	}
+	for _, tt := range tests {
+		got := tokenizeSubject(tt.subject)
+		if len(got) != len(tt.want) {
+			t.Fatalf("tokenizeSubject(%q) = %q, want %q", tt.subject, got, tt.want)
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Fatalf("tokenizeSubject(%q) = %q, want %q", tt.subject, got, tt.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package server
+
+import "sync"
+
+// Sublist is a subscription trie indexing topics by their (possibly
+// wildcarded) subject, so a published subject is matched against all
+// subscriptions in time proportional to its depth rather than the number of
+// topics.
+type Sublist struct {
+	mu    sync.RWMutex
+	root  *level
+	count int
+}
+
+type level struct {
+	nodes map[string]*node
+	pwc   *node
+	fwc   *node
+}
+
+type node struct {
+	next   *level
+	topics []*Topic
+}
+
+func newLevel() *level {
+	return &level{nodes: make(map[string]*node)}
+}
+
+func (l *level) isEmpty() bool {
+	return len(l.nodes) == 0 && l.pwc == nil && l.fwc == nil
+}
+
+func (n *node) isEmpty() bool {
+	return len(n.topics) == 0 && (n.next == nil || n.next.isEmpty())
+}
+
+func NewSublist() *Sublist {
+	return &Sublist{root: newLevel()}
+}
+
+func (s *Sublist) Insert(topic *Topic) {
+	tokens := tokenizeSubject(topic.name)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l := s.root
+	var n *node
+	for i, token := range tokens {
+		switch {
+		case isPwc(token):
+			if l.pwc == nil {
+				l.pwc = &node{}
+			}
+			n = l.pwc
+		case isFwc(token):
+			if l.fwc == nil {
+				l.fwc = &node{}
+			}
+			n = l.fwc
+		default:
+			if n = l.nodes[token]; n == nil {
+				n = &node{}
+				l.nodes[token] = n
+			}
+		}
+		if i < len(tokens)-1 {
+			if n.next == nil {
+				n.next = newLevel()
+			}
+			l = n.next
+		}
+	}
+	if n == nil {
+		return
+	}
+	n.topics = append(n.topics, topic)
+	s.count++
+}
+
+func (s *Sublist) Remove(topic *Topic) {
+	tokens := tokenizeSubject(topic.name)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.remove(s.root, tokens, topic)
+}
+
+// remove walks down the trie and prunes nodes left empty on the way back.
+func (s *Sublist) remove(l *level, tokens []string, topic *Topic) {
+	if l == nil || len(tokens) == 0 {
+		return
+	}
+	token := tokens[0]
+
+	var n *node
+	switch {
+	case isPwc(token):
+		n = l.pwc
+	case isFwc(token):
+		n = l.fwc
+	default:
+		n = l.nodes[token]
+	}
+	if n == nil {
+		return
+	}
+
+	if len(tokens) == 1 {
+		for i, t := range n.topics {
+			if t == topic {
+				n.topics = append(n.topics[:i], n.topics[i+1:]...)
+				s.count--
+				break
+			}
+		}
+	} else {
+		s.remove(n.next, tokens[1:], topic)
+	}
+
+	if !n.isEmpty() {
+		return
+	}
+	switch {
+	case isPwc(token):
+		l.pwc = nil
+	case isFwc(token):
+		l.fwc = nil
+	default:
+		delete(l.nodes, token)
+	}
+}
+
+// Match returns every topic whose subject matches the concrete subject.
+func (s *Sublist) Match(subject string) []*Topic {
+	tokens := tokenizeSubject(subject)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var result []*Topic
+	matchLevel(s.root, tokens, &result)
+	return result
+}
+
+func matchLevel(l *level, tokens []string, result *[]*Topic) {
+	for i, token := range tokens {
+		if l == nil {
+			return
+		}
+		if l.fwc != nil {
+			*result = append(*result, l.fwc.topics...)
+		}
+		if l.pwc != nil {
+			matchLevel(l.pwc.next, tokens[i+1:], result)
+			if i == len(tokens)-1 {
+				*result = append(*result, l.pwc.topics...)
+			}
+		}
+		n := l.nodes[token]
+		if n == nil {
+			return
+		}
+		if i == len(tokens)-1 {
+			*result = append(*result, n.topics...)
+			return
+		}
+		l = n.next
+	}
+}
+
+// Count returns the number of topics in the trie.
+func (s *Sublist) Count() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.count
+}
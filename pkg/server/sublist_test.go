@@ -0,0 +1,112 @@
+package server
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func topicNames(topics []*Topic) string {
+	names := make([]string, 0, len(topics))
+	for _, t := range topics {
+		names = append(names, t.Name())
+	}
+	sort.Strings(names)
+	return strings.Join(names, " ")
+}
+
+func newTestSublist(subjects ...string) (*Sublist, map[string]*Topic) {
+	s := NewSublist()
+	topics := make(map[string]*Topic, len(subjects))
+	for _, subject := range subjects {
+		t := NewTopic(subject)
+		topics[subject] = t
+		s.Insert(t)
+	}
+	return s, topics
+}
+
+func TestSublistMatch(t *testing.T) {
+	s, _ := newTestSublist(
+		"a", "a.b", "a.b.c", "a/b", "*.b", "a.*", "a.>", "a/#", "+.+.c", ">", "b.>", "*.*.*.d",
+	)
+
+	tests := []struct {
+		subject string
+		want    string
+	}{
+		{"a", "> a"},
+		{"a.b", "*.b > a.* a.> a.b a/# a/b"},
+		{"a/b", "*.b > a.* a.> a.b a/# a/b"},
+		{"a.b.c", "+.+.c > a.> a.b.c a/#"},
+		{"a.c", "> a.* a.> a/#"},
+		{"x.b", "*.b >"},
+		{"b", ">"},
+		{"b.c", "> b.>"},
+		{"x.y.z.d", "*.*.*.d >"},
+		{"x.y.z", ">"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.subject, func(t *testing.T) {
+			if got := topicNames(s.Match(tt.subject)); got != tt.want {
+				t.Fatalf("Match(%q) = %q, want %q", tt.subject, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSublistRemove(t *testing.T) {
+	subjects := []string{"a.b", "a.*", "a.>", "*.b", "a.b.c", "x"}
+	s, topics := newTestSublist(subjects...)
+	dup := NewTopic("a.b")
+	s.Insert(dup)
+
+	tests := []struct {
+		remove  *Topic
+		subject string
+		want    string
+		count   int
+	}{
+		{remove: topics["a.b"], subject: "a.b", want: "*.b a.* a.> a.b", count: 6},
+		{remove: dup, subject: "a.b", want: "*.b a.* a.>", count: 5},
+		{remove: dup, subject: "a.b", want: "*.b a.* a.>", count: 5},
+		{remove: topics["a.*"], subject: "a.b", want: "*.b a.>", count: 4},
+		{remove: topics["a.>"], subject: "a.b.c", want: "a.b.c", count: 3},
+		{remove: NewTopic("a.b.d"), subject: "a.b.c", want: "a.b.c", count: 3},
+		{remove: topics["*.b"], subject: "a.b", want: "", count: 2},
+	}
+	for _, tt := range tests {
+		s.Remove(tt.remove)
+		if got := topicNames(s.Match(tt.subject)); got != tt.want {
+			t.Fatalf("after removing %q, Match(%q) = %q, want %q", tt.remove.Name(), tt.subject, got, tt.want)
+		}
+		if got := s.Count(); got != tt.count {
+			t.Fatalf("after removing %q, Count() = %d, want %d", tt.remove.Name(), got, tt.count)
+		}
+	}
+}
+
+func TestSublistPrune(t *testing.T) {
+	s, topics := newTestSublist("a.b.c", "a.*.c", "a.>", "d")
+	for _, subject := range []string{"a.b.c", "a.*.c", "a.>", "d"} {
+		s.Remove(topics[subject])
+	}
+
+	if !s.root.isEmpty() {
+		t.Fatalf("root level not pruned: %d nodes, pwc %v, fwc %v", len(s.root.nodes), s.root.pwc, s.root.fwc)
+	}
+	if got := s.Count(); got != 0 {
+		t.Fatalf("Count() = %d, want 0", got)
+	}
+
+	// a branch still holding a topic below is kept
+	s, topics = newTestSublist("a.b", "a.b.c")
+	s.Remove(topics["a.b"])
+	n := s.root.nodes["a"]
+	if n == nil || n.next.nodes["b"] == nil {
+		t.Fatal("branch of a.b.c pruned")
+	}
+	if got := topicNames(s.Match("a.b.c")); got != "a.b.c" {
+		t.Fatalf("Match(a.b.c) = %q, want a.b.c", got)
+	}
+}
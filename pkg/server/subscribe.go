@@ -1,33 +1,295 @@
 package server
 
-import "sync"
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/netraitcorp/netick/pkg/log"
+	"github.com/netraitcorp/netick/pkg/metrics"
+)
 
 type Subscribe struct {
-	topics sync.Map
-	mu     sync.Mutex
+	topics  sync.Map
+	sublist *Sublist
+	mu      sync.Mutex
+	// pubMu orders sequence assignment with queueing to the topics, so a new
+	// subscription splits the stream between replay and live delivery. The
+	// topics queue without blocking, a lagging topic holds no publisher.
+	pubMu sync.Mutex
 }
 
 var subscribe = NewSubscribe()
 
 func NewSubscribe() *Subscribe {
-	return &Subscribe{}
+	return &Subscribe{
+		sublist: NewSublist(),
+	}
 }
 
-func (s *Subscribe) Subscribe(subsName string) *Topic {
+// Subscribe attaches acc to subsName, replay selects the history delivered
+// before the messages published from now on.
+func (s *Subscribe) Subscribe(subsName string, acc *Account, replay *Replay) *Topic {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	var topic *Topic
-	t, ok := s.topics.Load(subsName)
+	topic := s.topic(subsName)
+	if _, ok := acc.topics.Load(subsName); !ok {
+		metrics.Subscriptions.WithLabelValues(subsName).Inc()
+	}
+
+	s.pubMu.Lock()
+	msgs := withRetained(retained.match(subsName), history.replay(subsName, replay))
+	topic.Subscribe(acc, history.LastSeq(), msgs)
+	s.pubMu.Unlock()
+	acc.topics.Store(subsName, topic)
+
+	return topic
+}
+
+// SubscribeDurable attaches acc to the durable subscription name of its
+// identity, created on subsName with replay unless it exists. An existing
+// durable must be subscribed to subsName. The pending messages are sent
+// outside the subscription lock.
+func (s *Subscribe) SubscribeDurable(subsName, name string, acc *Account, replay *Replay) (*Durable, error) {
+	d, err := s.durable(subsName, name, acc, replay)
+	if err != nil {
+		return nil, err
+	}
+	if !d.attach(acc) {
+		return nil, fmt.Errorf("durable %s was removed", name)
+	}
+	return d, nil
+}
+
+// durable returns the durable subscription name of the identity of acc, it
+// is created if needed.
+func (s *Subscribe) durable(subsName, name string, acc *Account, replay *Replay) (*Durable, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	identity := acc.Identity().Name
+	d, ok := durables.get(identity, name)
+	if ok && d.Subject() != subsName {
+		return nil, fmt.Errorf("durable %s is subscribed to %s", name, d.Subject())
+	}
 	if !ok {
-		topic = NewTopic(subsName)
-		go topic.BroadcastLoop()
+		topic := s.topic(subsName)
+		metrics.Subscriptions.WithLabelValues(subsName).Inc()
 
-		s.topics.Store(subsName, topic)
-	} else {
-		topic = t.(*Topic)
+		s.pubMu.Lock()
+		d = NewDurable(identity, name, subsName, withRetained(retained.match(subsName), history.replay(subsName, replay)))
+		topic.subscribeDurable(d, history.LastSeq())
+		s.pubMu.Unlock()
+		durables.add(d)
+		log.Info("Subscribe.durable: created, durable: %s, topic: %s, identity: %s", name, subsName, identity)
 	}
-	//topic.Subscribe(c)
+	return d, nil
+}
 
+// DeleteDurable removes the durable subscription name of identity and
+// reports whether it existed.
+func (s *Subscribe) DeleteDurable(identity, name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := durables.get(identity, name)
+	if !ok {
+		return false
+	}
+	s.deleteDurable(d)
+	return true
+}
+
+// expireDurable removes d unless a connection attached to it meanwhile.
+func (s *Subscribe) expireDurable(d *Durable) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if d.attached() {
+		return
+	}
+	log.Info("Subscribe.expireDurable: durable: %s, identity: %s", d.Name(), d.identity)
+	s.deleteDurable(d)
+}
+
+func (s *Subscribe) deleteDurable(d *Durable) {
+	durables.remove(d)
+	d.stop()
+
+	t, ok := s.topics.Load(d.Subject())
+	if !ok {
+		return
+	}
+	topic := t.(*Topic)
+	topic.UnSubscribe(d.key())
+	metrics.Subscriptions.WithLabelValues(d.Subject()).Dec()
+	s.release(d.Subject(), topic)
+}
+
+// topic returns the topic of subsName, it is created and started if needed.
+func (s *Subscribe) topic(subsName string) *Topic {
+	if t, ok := s.topics.Load(subsName); ok {
+		return t.(*Topic)
+	}
+	topic := NewTopic(subsName)
+	metrics.Topics.Inc()
+	go topic.BroadcastLoop()
+
+	s.topics.Store(subsName, topic)
+	s.sublist.Insert(topic)
 	return topic
 }
+
+// UnSubscribe detaches acc from the topic and tears the topic down once
+// nobody is subscribed to it any more.
+func (s *Subscribe) UnSubscribe(subsName string, acc *Account) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.unSubscribe(subsName, acc)
+}
+
+func (s *Subscribe) UnSubscribeAll(acc *Account) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc.topics.Range(func(key, _ interface{}) bool {
+		s.unSubscribe(key.(string), acc)
+		return true
+	})
+}
+
+func (s *Subscribe) unSubscribe(subsName string, acc *Account) bool {
+	t, ok := acc.topics.Load(subsName)
+	if !ok {
+		return false
+	}
+	acc.topics.Delete(subsName)
+
+	topic := t.(*Topic)
+	topic.UnSubscribe(acc.ID())
+	metrics.Subscriptions.WithLabelValues(subsName).Dec()
+	s.release(subsName, topic)
+	return true
+}
+
+// release tears topic down once nobody is subscribed to it any more.
+func (s *Subscribe) release(subsName string, topic *Topic) {
+	if !topic.HaveAccount() {
+		metrics.Subscriptions.DeleteLabelValues(subsName)
+		s.topics.Delete(subsName)
+		s.sublist.Remove(topic)
+		topic.Stop()
+
+		s.pubMu.Lock()
+		released := retained.release(subsName, func(subject string) bool {
+			return len(s.Match(subject)) > 0
+		})
+		for _, subject := range released {
+			journal.clear(subject)
+		}
+		s.pubMu.Unlock()
+	}
+}
+
+// StopAll tears down every topic regardless of its subscribers.
+func (s *Subscribe) StopAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.topics.Range(func(key, value interface{}) bool {
+		topic := value.(*Topic)
+		metrics.Subscriptions.DeleteLabelValues(key.(string))
+		s.topics.Delete(key)
+		s.sublist.Remove(topic)
+		topic.Stop()
+		return true
+	})
+}
+
+func (s *Subscribe) Topic(subsName string) (*Topic, bool) {
+	t, ok := s.topics.Load(subsName)
+	if !ok {
+		return nil, false
+	}
+	return t.(*Topic), true
+}
+
+// Publish assigns the next sequence number to a message and queues it for
+// the topics matching subject. With retain the message also becomes the
+// retained value of subject, a retained publish without data clears it.
+// With a deadline, for the Block policy, Publish waits until the message was
+// handed to every subscriber or the deadline passed.
+func (s *Subscribe) Publish(subject string, data []byte, retain bool, deadline time.Time) {
+	waits := s.publish(subject, data, retain, deadline)
+	if len(waits) == 0 {
+		return
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	for _, done := range waits {
+		select {
+		case <-done:
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+func (s *Subscribe) publish(subject string, data []byte, retain bool, deadline time.Time) []<-chan struct{} {
+	s.pubMu.Lock()
+	defer s.pubMu.Unlock()
+
+	if retain && len(data) == 0 {
+		s.clearRetained(subject)
+		return nil
+	}
+
+	metrics.MessagesIn.Inc()
+	metrics.BytesIn.Add(float64(len(data)))
+
+	msg := history.append(subject, data)
+	if retain {
+		retained.store(msg)
+	}
+	journal.append(msg, retain)
+	var waits []<-chan struct{}
+	for _, topic := range s.Match(subject) {
+		if done := topic.Publish(msg, deadline); done != nil {
+			waits = append(waits, done)
+		}
+	}
+	return waits
+}
+
+// ClearRetained drops the retained value of subject and reports whether
+// there was one.
+func (s *Subscribe) ClearRetained(subject string) bool {
+	s.pubMu.Lock()
+	defer s.pubMu.Unlock()
+
+	return s.clearRetained(subject)
+}
+
+func (s *Subscribe) clearRetained(subject string) bool {
+	if !retained.Clear(subject) {
+		return false
+	}
+	journal.clear(subject)
+	return true
+}
+
+// Range calls f for every topic until it returns false.
+func (s *Subscribe) Range(f func(topic *Topic) bool) {
+	s.topics.Range(func(_, value interface{}) bool {
+		return f(value.(*Topic))
+	})
+}
+
+// Match returns the topics whose subscription subject matches the concrete
+// subject a message was published to.
+func (s *Subscribe) Match(subject string) []*Topic {
+	return s.sublist.Match(subject)
+}
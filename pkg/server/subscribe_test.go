@@ -0,0 +1,201 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/netraitcorp/netick/pb"
+)
+
+// publishN publishes n messages to subject and returns them as kept by
+// history.
+func publishN(t *testing.T, s *Subscribe, subject string, n int, retain bool) []*pb.Message {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		s.Publish(subject, []byte(fmt.Sprintf("%d", i)), retain, time.Time{})
+	}
+	msgs := history.replay(subject, &Replay{Last: n})
+	if len(msgs) != n {
+		t.Fatalf("history kept %d messages, want %d", len(msgs), n)
+	}
+	return msgs
+}
+
+// seqs returns the sequence numbers of msgs.
+func seqs(msgs []*pb.Message) []uint64 {
+	s := make([]uint64, 0, len(msgs))
+	for _, msg := range msgs {
+		s = append(s, msg.Seq)
+	}
+	return s
+}
+
+func TestSubscribeReplayThenLive(t *testing.T) {
+	const (
+		before = 20
+		// live messages are published until the subscription is made and
+		// as many after it.
+		live = 50
+	)
+
+	tests := []struct {
+		name   string
+		replay func(pre []*pb.Message, since time.Time) *Replay
+		// first is the index of the first message published before the
+		// subscription that is replayed, exact unless live messages may take
+		// its place.
+		first int
+		exact bool
+	}{
+		{
+			name:   "replay_seq",
+			replay: func(pre []*pb.Message, _ time.Time) *Replay { return &Replay{Seq: pre[5].Seq} },
+			first:  5, exact: true,
+		},
+		{
+			name:   "replay_time",
+			replay: func(_ []*pb.Message, since time.Time) *Replay { return &Replay{Time: since} },
+			first:  before / 2, exact: true,
+		},
+		{
+			name:   "replay_last",
+			replay: func([]*pb.Message, time.Time) *Replay { return &Replay{Last: 3} },
+			first:  before - 3,
+		},
+	}
+
+	defer history.configure(history.options())
+	history.configure(&HistoryOptions{MaxMessages: 1 << 20})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSubscribe()
+			defer s.StopAll()
+			subject := "replay." + tt.name
+
+			pre := publishN(t, s, subject, before/2, false)
+			time.Sleep(2 * time.Millisecond)
+			since := time.Now()
+			pre = append(pre, publishN(t, s, subject, before/2, false)...)
+
+			// subscribe while messages are being published
+			started := make(chan struct{})
+			subscribed := make(chan struct{})
+			published := make(chan uint64)
+			go func() {
+				wait, after := subscribed, -1
+				for i := 0; after < live; i++ {
+					if i == live {
+						close(started)
+					}
+					select {
+					case <-wait:
+						wait, after = nil, 0
+					default:
+					}
+					if after >= 0 {
+						after++
+					}
+					s.Publish(subject, []byte("live"), false, time.Time{})
+					time.Sleep(50 * time.Microsecond)
+				}
+				published <- history.LastSeq()
+			}()
+			<-started
+			acc, conn := newTestAccount(NewOptions())
+			s.Subscribe(subject, acc, tt.replay(pre, since))
+			close(subscribed)
+			last := <-published
+
+			want := pre[tt.first].Seq
+			first := conn.waitMessages(t, 1)[0].Seq
+			conn.waitMessages(t, int(last-first+1))
+			// give duplicates the time to show up
+			time.Sleep(10 * time.Millisecond)
+			got := seqs(conn.messages())
+			if (tt.exact && got[0] != want) || got[0] < want {
+				t.Fatalf("first message %d, want %d", got[0], want)
+			}
+			for i := 1; i < len(got); i++ {
+				if got[i] != got[i-1]+1 {
+					t.Fatalf("message %d follows %d, want each message once and in order", got[i], got[i-1])
+				}
+			}
+			if got[len(got)-1] != last {
+				t.Fatalf("last message %d, want %d", got[len(got)-1], last)
+			}
+		})
+	}
+}
+
+func TestSubscribeReplayRetained(t *testing.T) {
+	defer history.configure(history.options())
+	history.configure(&HistoryOptions{MaxMessages: 10})
+	s := NewSubscribe()
+	defer s.StopAll()
+	subject := "replay.retained"
+	defer retained.Clear(subject)
+
+	pre := publishN(t, s, subject, 2, false)
+	pre = append(pre, publishN(t, s, subject, 3, true)...)
+	pre = append(pre, publishN(t, s, subject, 1, false)...)
+
+	acc, conn := newTestAccount(NewOptions())
+	s.Subscribe(subject, acc, &Replay{Seq: pre[0].Seq})
+	conn.waitMessages(t, len(pre))
+	time.Sleep(10 * time.Millisecond)
+	msgs := conn.messages()
+
+	// the retained value comes first and is not replayed again
+	want := append([]uint64{pre[4].Seq}, seqs(pre[:4])...)
+	want = append(want, pre[5].Seq)
+	if got := seqs(msgs); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got messages %v, want %v", got, want)
+	}
+	if !msgs[0].Retained {
+		t.Fatal("first message not flagged retained")
+	}
+	for _, msg := range msgs[1:] {
+		if msg.Retained {
+			t.Fatalf("replayed message %d flagged retained", msg.Seq)
+		}
+	}
+}
+
+func TestWithRetained(t *testing.T) {
+	msg := func(seq uint64, retained bool) *pb.Message {
+		return &pb.Message{Seq: seq, Retained: retained}
+	}
+
+	tests := []struct {
+		name   string
+		values []*pb.Message
+		replay []*pb.Message
+		want   string
+	}{
+		{name: "replay only", replay: []*pb.Message{msg(1, false), msg(2, false)}, want: "1 2"},
+		{name: "retained only", values: []*pb.Message{msg(3, true)}, want: "3r"},
+		{name: "disjoint", values: []*pb.Message{msg(1, true)}, replay: []*pb.Message{msg(2, false), msg(3, false)}, want: "1r 2 3"},
+		{
+			name:   "retained value replayed",
+			values: []*pb.Message{msg(2, true), msg(4, true)},
+			replay: []*pb.Message{msg(1, false), msg(2, false), msg(3, false), msg(4, false)},
+			want:   "2r 4r 1 3",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, m := range withRetained(tt.values, tt.replay) {
+				s := fmt.Sprint(m.Seq)
+				if m.Retained {
+					s += "r"
+				}
+				got = append(got, s)
+			}
+			if s := fmt.Sprint(got); s != "["+tt.want+"]" {
+				t.Fatalf("withRetained = %s, want [%s]", s, tt.want)
+			}
+		})
+	}
+}
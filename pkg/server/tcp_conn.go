@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"fmt"
 	"net"
@@ -9,12 +10,18 @@ import (
 	"sync"
 	"time"
 
+	"github.com/golang/snappy"
 	"github.com/netraitcorp/netick/pkg/log"
+	"github.com/netraitcorp/netick/pkg/metrics"
+	"github.com/netraitcorp/netick/pkg/types"
 	"github.com/netraitcorp/netick/pkg/util"
 )
 
 const (
 	HeadPackSizeLen = 4
+	// HeadCompressedFlag is set in the length header of frames whose body is
+	// snappy compressed, the remaining bits hold the length.
+	HeadCompressedFlag = 1 << 31
 )
 
 type TCPConn struct {
@@ -22,9 +29,10 @@ type TCPConn struct {
 	conn      net.Conn
 	ping      pingt
 	connID    string
-	wb        chan []byte
+	queue     *sendQueue
 	rb        []byte
 	rblen     uint32
+	rbflag    uint32
 	handler   Handler
 	cancelCtx context.CancelFunc
 	closed    bool
@@ -38,11 +46,14 @@ func NewTCPConn(rw net.Conn, srv Server) *TCPConn {
 		srv:    srv,
 		conn:   rw,
 		connID: util.Sha1(rawConnKey + strconv.Itoa(util.RandInt())),
-		wb:     make(chan []byte, 0x40),
 		closed: false,
 	}
+	c.queue = newSendQueue(c.connID)
 	c.handler = NewReadHandler(c)
 	c.handler.CreateConn()
+	metrics.Connections.WithLabelValues(metrics.TransportTCP).Inc()
+
+	c.startPingTimer()
 
 	log.Info("NewTCPConn: %s, cid: %s", rawConnKey, c.ConnID())
 
@@ -65,15 +76,32 @@ func (c *TCPConn) RemoteAddr() net.Addr {
 	return c.conn.RemoteAddr()
 }
 
+func (c *TCPConn) TLSState() *tls.ConnectionState {
+	if tc, ok := c.conn.(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		return &state
+	}
+	return nil
+}
+
 func (c *TCPConn) Accept() {
 	ctx, cancelCtx := context.WithCancel(context.Background())
 	c.cancelCtx = cancelCtx
 
-	readCtx, _ := context.WithCancel(ctx)
-	go c.loopRead(readCtx)
+	go c.loopRead(ctx)
+	go c.loopWrite(ctx)
+}
+
+func (c *TCPConn) Buffered() int {
+	return c.queue.buffered()
+}
 
-	writeCtx, _ := context.WithCancel(ctx)
-	go c.loopWrite(writeCtx)
+func (c *TCPConn) SlowConsumer() SlowConsumerStats {
+	return c.queue.slowConsumer()
+}
+
+func (c *TCPConn) Unsent() [][]byte {
+	return c.queue.drain()
 }
 
 func (c *TCPConn) Closed() bool {
@@ -100,10 +128,9 @@ func (c *TCPConn) Close() error {
 		c.handler.Close()
 	}
 
-	if c.ping.timer != nil {
-		c.ping.timer.Stop()
-		c.ping.timer = nil
-	}
+	c.ping.stop()
+	c.queue.close()
+	metrics.Connections.WithLabelValues(metrics.TransportTCP).Dec()
 
 	log.Info("CloseTCPConn: cid: %s", c.ConnID())
 
@@ -111,15 +138,14 @@ func (c *TCPConn) Close() error {
 }
 
 func (c *TCPConn) Write(data []byte) error {
+	return c.Send(data, c.srv.Options().SlowConsumer.Policy, time.Time{})
+}
+
+func (c *TCPConn) Send(data []byte, policy SlowConsumerPolicy, deadline time.Time) error {
 	if c.closed {
-		return fmt.Errorf("TCPConn.Write: connection closed")
-	}
-	select {
-	case c.wb <- data:
-		return nil
-	default:
-		return fmt.Errorf("TCPConn.Write: write buf full")
+		return fmt.Errorf("TCPConn.Send: connection closed")
 	}
+	return enqueue(c, c.queue, data, policy, deadline)
 }
 
 func (c *TCPConn) loopRead(ctx context.Context) {
@@ -139,65 +165,185 @@ func (c *TCPConn) loopRead(ctx context.Context) {
 		}
 		c.rb = append(c.rb, rb[:n]...)
 		for {
-			b := c.unPacket()
+			b, err := c.unPacket()
+			if err != nil {
+				log.Error("LoopRead error: cid: %s, err: %s", c.ConnID(), err.Error())
+				_ = c.Close()
+				return
+			}
 			if len(b) == 0 {
 				break
 			}
-			c.readHandler(b)
+			if !c.readHandler(b) {
+				return
+			}
 		}
 	}
 }
 
-func (c *TCPConn) readHandler(b []byte) {
+func (c *TCPConn) readHandler(b []byte) bool {
 	if c.handler != nil {
 		if err := c.handler.ReadData(b); err != nil {
 			log.Error("Handler.ReadData error: cid: %s, err: %s", c.ConnID(), err.Error())
-			_ = c.Close()
-			return
+			flushAndClose(c)
+			return false
 		}
 	}
+	return true
 }
 
-func (c *TCPConn) unPacket() []byte {
+// unPacket returns the next frame read, nil until it is complete. Frames
+// beyond MaxFrameSize, before or after decompression, and compressed frames
+// from clients that did not negotiate FeatureCompression are rejected.
+func (c *TCPConn) unPacket() ([]byte, error) {
+	maxSize := c.srv.Options().MaxFrameSize
 	if c.rblen == 0 {
 		if len(c.rb) < HeadPackSizeLen {
-			return nil
+			return nil, nil
 		}
-		c.rblen = binary.BigEndian.Uint32(c.rb[:HeadPackSizeLen])
+		head := binary.BigEndian.Uint32(c.rb[:HeadPackSizeLen])
+		c.rblen = head &^ HeadCompressedFlag
+		c.rbflag = head & HeadCompressedFlag
 		c.rb = c.rb[HeadPackSizeLen:]
+
+		if c.rbflag != 0 && c.handler.Features()&types.FeatureCompression == 0 {
+			return nil, fmt.Errorf("TCPConn.unPacket: compressed frame without compression feature")
+		}
+		if maxSize > 0 && int(c.rblen) > maxSize {
+			return nil, fmt.Errorf("TCPConn.unPacket: frame of %d bytes exceeds the limit of %d", c.rblen, maxSize)
+		}
 	}
 	if int(c.rblen) > len(c.rb) {
-		return nil
+		return nil, nil
 	}
 
 	rb := c.rb[:c.rblen]
+	compressed := c.rbflag != 0
 
 	c.rb = c.rb[c.rblen:]
 	c.rblen = 0
+	c.rbflag = 0
+
+	if !compressed {
+		return rb, nil
+	}
+	n, err := snappy.DecodedLen(rb)
+	if err != nil {
+		return nil, fmt.Errorf("TCPConn.unPacket: decompress failed, %s", err.Error())
+	}
+	if maxSize > 0 && n > maxSize {
+		return nil, fmt.Errorf("TCPConn.unPacket: decompressed frame of %d bytes exceeds the limit of %d", n, maxSize)
+	}
+	data, err := snappy.Decode(nil, rb)
+	if err != nil {
+		return nil, fmt.Errorf("TCPConn.unPacket: decompress failed, %s", err.Error())
+	}
+	return data, nil
+}
+
+// pack prefixes data with its length, frames from the compression threshold
+// on are compressed when the client negotiated FeatureCompression.
+func (c *TCPConn) pack(data []byte) []byte {
+	var flag uint32
+	threshold := c.srv.Options().Compression.Threshold
+	if threshold > 0 && len(data) >= threshold && c.handler.Features()&types.FeatureCompression != 0 {
+		if enc := snappy.Encode(nil, data); len(enc) < len(data) {
+			data = enc
+			flag = HeadCompressedFlag
+		}
+	}
 
-	return rb
+	b := make([]byte, HeadPackSizeLen+len(data))
+	binary.BigEndian.PutUint32(b[:HeadPackSizeLen], uint32(len(data))|flag)
+	copy(b[HeadPackSizeLen:], data)
+	return b
 }
 
 func (c *TCPConn) loopWrite(ctx context.Context) {
 	for {
 		select {
-		case data := <-c.wb:
-			d := time.Duration(len(data)/0x19000)*time.Second + writeWait
-			_ = c.conn.SetWriteDeadline(time.Now().Add(d))
-			for {
-				n, err := c.conn.Write(data)
-				if err != nil {
-					log.Error("Write error: cid: %s, err: %s", c.ConnID(), err.Error())
-					_ = c.Close()
-					return
-				}
-				if n < len(data) {
-					data = data[n:]
-					continue
-				}
+		case <-c.queue.ready:
+			frames := coalesce(ctx, c.queue, c.srv.Options().Batch)
+			if len(frames) == 0 {
+				continue
+			}
+			err := c.writeFrames(frames)
+			c.queue.written(len(frames))
+			if err != nil {
+				log.Error("Write error: cid: %s, err: %s", c.ConnID(), err.Error())
+				_ = c.Close()
+				return
 			}
 		case <-ctx.Done():
 			return
 		}
 	}
 }
+
+// writeFrames sends frames in a single batch frame when the client
+// negotiated FeatureBatching, in a single vectored write otherwise.
+func (c *TCPConn) writeFrames(frames [][]byte) error {
+	if len(frames) > 1 && c.handler.Features()&types.FeatureBatching != 0 {
+		data, err := batchFrame(c.Codec(), frames)
+		if err != nil {
+			return err
+		}
+		frames = [][]byte{data}
+	}
+
+	bufs := make(net.Buffers, len(frames))
+	for i, data := range frames {
+		bufs[i] = c.pack(data)
+	}
+	d := time.Duration(frameSize(bufs)/0x19000)*time.Second + writeWait
+	_ = c.conn.SetWriteDeadline(time.Now().Add(d))
+	_, err := bufs.WriteTo(c.conn)
+	return err
+}
+
+// Codec returns the protobuf codec, the only one spoken over TCP.
+func (c *TCPConn) Codec() Codec {
+	return packet
+}
+
+func (c *TCPConn) Heartbeat(rtt time.Duration) {
+	c.ping.seen(rtt)
+	if rtt > 0 {
+		metrics.PingRTT.WithLabelValues(metrics.TransportTCP).Observe(rtt.Seconds())
+	}
+}
+
+func (c *TCPConn) RTT() time.Duration {
+	return c.ping.roundTrip()
+}
+
+func (c *TCPConn) startPingTimer() {
+	c.ping.seen(0)
+	c.ping.schedule(c.srv.Options().PingInterval, c.loopPingTimer)
+}
+
+// loopPingTimer sends opcode level pings, raw TCP has no control frames.
+func (c *TCPConn) loopPingTimer() {
+	if c.closed {
+		return
+	}
+
+	opts := c.srv.Options()
+	if c.ping.timedOut(opts) {
+		log.Info("LoopPingTimer: ping timeout, cid: %s", c.ConnID())
+		_ = c.Close()
+		return
+	}
+
+	data, err := pingFrame(c.Codec())
+	if err == nil {
+		err = c.Write(data)
+	}
+	if err != nil {
+		log.Warn("LoopPingTimer: write ping failed, cid: %s, %s", c.ConnID(), err.Error())
+		_ = c.Close()
+		return
+	}
+
+	c.ping.schedule(opts.PingInterval, c.loopPingTimer)
+}
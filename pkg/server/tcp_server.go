@@ -1,16 +1,24 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"net"
-	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/gorilla/websocket"
+	"github.com/netraitcorp/netick/pkg/log"
+	"github.com/netraitcorp/netick/pkg/safe"
 )
 
 type TCPServer struct {
-	opts *Options
-	addr string
+	opts     atomic.Value
+	addr     string
+	tls      *TLSOptions
+	ln       net.Listener
+	shutdown safe.AtomicBool
+	mu       sync.Mutex
 }
 
 func (srv *TCPServer) ListenAndServe() error {
@@ -18,14 +26,49 @@ func (srv *TCPServer) ListenAndServe() error {
 	if err != nil {
 		return err
 	}
+	if srv.tls != nil {
+		cfg, err := srv.tls.TLSConfig()
+		if err != nil {
+			_ = ln.Close()
+			return err
+		}
+		ln = tls.NewListener(ln, cfg)
+	}
+
+	srv.mu.Lock()
+	srv.ln = ln
+	srv.mu.Unlock()
+	if srv.shutdown.IsSet() {
+		_ = ln.Close()
+		return nil
+	}
+
 	return srv.serve(ln)
 }
 
+// Shutdown stops accepting new connections, established connections must be
+// drained with DrainConns.
+func (srv *TCPServer) Shutdown(ctx context.Context) error {
+	srv.shutdown.Set()
+
+	srv.mu.Lock()
+	ln := srv.ln
+	srv.mu.Unlock()
+
+	if ln == nil {
+		return nil
+	}
+	return ln.Close()
+}
+
 func (srv *TCPServer) serve(ln net.Listener) error {
 	var tempDelay time.Duration
 	for {
 		rw, err := ln.Accept()
 		if err != nil {
+			if srv.shutdown.IsSet() {
+				return nil
+			}
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
 				if tempDelay == 0 {
 					tempDelay = 5 * time.Millisecond
@@ -35,7 +78,7 @@ func (srv *TCPServer) serve(ln net.Listener) error {
 				if max := 1 * time.Second; tempDelay > max {
 					tempDelay = max
 				}
-				//log.Printf("[ERROR] tcp: Accept error: %v; retrying in %v", err, tempDelay)
+				log.Error("TCPServer.serve: accept error: %v; retrying in %v", err, tempDelay)
 				time.Sleep(tempDelay)
 				continue
 			}
@@ -43,9 +86,25 @@ func (srv *TCPServer) serve(ln net.Listener) error {
 		}
 		tempDelay = 0
 
-		c := srv.createConn(rw)
-		c.Accept()
+		go srv.serveConn(rw)
+	}
+}
+
+func (srv *TCPServer) serveConn(rw net.Conn) {
+	// complete the TLS handshake before the connection is registered so the
+	// client certificate is known to the handler
+	if tc, ok := rw.(*tls.Conn); ok {
+		_ = tc.SetDeadline(time.Now().Add(srv.Options().Auth.Timeout))
+		if err := tc.Handshake(); err != nil {
+			log.Error("TCPServer.serveConn: tls handshake failed, remote: %s, err: %s", rw.RemoteAddr().String(), err.Error())
+			_ = rw.Close()
+			return
+		}
+		_ = tc.SetDeadline(time.Time{})
 	}
+
+	c := srv.createConn(rw)
+	c.Accept()
 }
 
 func (srv *TCPServer) createConn(rw net.Conn) Conn {
@@ -53,24 +112,23 @@ func (srv *TCPServer) createConn(rw net.Conn) Conn {
 }
 
 func (srv *TCPServer) Options() *Options {
-	return srv.opts
+	return srv.opts.Load().(*Options)
 }
 
-func RunTCPServer(opts *Options) error {
-	upgrader := &websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
-	}
+func (srv *TCPServer) Reload(opts *Options) {
+	srv.opts.Store(opts)
+}
 
-	srv := &WebsocketServer{
-		opts:     opts,
-		addr:     opts.Websocket.Addr,
-		rt:       opts.Websocket.ReadTimeout,
-		wt:       opts.Websocket.WriteTimeout,
-		upgrader: upgrader,
+func NewTCPServer(opts *Options) *TCPServer {
+	srv := &TCPServer{
+		addr: opts.TCP.Addr,
+		tls:  opts.TCP.TLS,
 	}
-	return srv.ListenAndServe()
+	srv.opts.Store(opts)
+	return srv
+}
+
+func RunTCPServer(opts *Options) error {
+	Configure(opts)
+	return NewTCPServer(opts).ListenAndServe()
 }
@@ -1,75 +1,258 @@
 package server
 
 import (
-	"fmt"
 	"sync"
+	"time"
+
+	"github.com/netraitcorp/netick/pb"
+	"github.com/netraitcorp/netick/pkg/log"
+	"github.com/netraitcorp/netick/pkg/metrics"
+	"github.com/netraitcorp/netick/pkg/types"
+)
+
+const (
+	// topicMaxMessages and topicMaxBytes bound the messages queued to a
+	// topic, beyond them a new message is dropped: publishers hold the
+	// publish lock of every subject and never wait for a lagging topic.
+	topicMaxMessages = 1024
+	topicMaxBytes    = 8 * 1024 * 1024
 )
 
 type Topic struct {
-	name           string
-	accs           sync.Map
-	broadcastQueue chan []byte
+	name   string
+	accs   sync.Map
+	mu     sync.Mutex
+	events []*topicEvent
+	// queued and size count the messages in events, replays are not bounded.
+	queued int
+	size   int
+	ready  chan struct{}
+	done   chan struct{}
+}
+
+// subscription attaches an account to a topic, messages up to seq after were
+// published before it and are not delivered live.
+type subscription struct {
+	acc     *Account
+	durable *Durable
+	after   uint64
+}
+
+// topicEvent is handled by BroadcastLoop in order, it is either a published
+// message or the replay of history to a new subscription. deadline bounds
+// the wait of the Block policy for msg, done is closed once msg was handed to
+// every subscriber when its publisher waits for it.
+type topicEvent struct {
+	msg      *pb.Message
+	deadline time.Time
+	done     chan struct{}
+	sub      *subscription
+	replay   []*pb.Message
 }
 
 func NewTopic(name string) *Topic {
 	t := &Topic{
-		name:           name,
-		broadcastQueue: make(chan []byte, 16),
+		name:  name,
+		ready: make(chan struct{}, 1),
+		done:  make(chan struct{}),
 	}
 	return t
 }
 
 func (t *Topic) BroadcastLoop() {
+	defer metrics.Topics.Dec()
+
 	for {
-		data := <-t.broadcastQueue
-		t.accs.Range(func(key, value interface{}) bool {
-			fmt.Println(data)
+		select {
+		case <-t.ready:
+		case <-t.done:
+			return
+		}
 
-			return true
-		})
+		events := t.take()
+		for i, ev := range events {
+			select {
+			case <-t.done:
+				release(events[i:])
+				return
+			default:
+			}
+			t.broadcast(ev)
+		}
 	}
 }
 
-func (t *Topic) Subscribe(acc *Account) {
-	t.accs.Store(acc.conn.ConnID(), acc)
+// take removes the queued events.
+func (t *Topic) take() []*topicEvent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	events := t.events
+	t.events = nil
+	t.queued = 0
+	t.size = 0
+	return events
 }
 
-func (t *Topic) UnSubscribe(id interface{}) {
-	t.accs.Delete(id)
+// release closes the done channels of events, their publishers stop waiting.
+func release(events []*topicEvent) {
+	for _, ev := range events {
+		if ev.done != nil {
+			close(ev.done)
+		}
+	}
 }
 
-func (t *Topic) HaveAccount() (exists bool) {
+func (t *Topic) broadcast(ev *topicEvent) {
+	if ev.done != nil {
+		defer close(ev.done)
+	}
+
+	if ev.sub != nil {
+		for _, msg := range ev.replay {
+			t.deliver(ev.sub.acc, msg, newFrameCache(types.OpMessage, msg), time.Time{})
+		}
+		return
+	}
+
+	// subscribers may use different codecs, encode once per codec
+	msg := ev.msg
+	frames := newFrameCache(types.OpMessage, msg)
 	t.accs.Range(func(key, value interface{}) bool {
-		exists = true
-		return false
+		sub := value.(*subscription)
+		switch {
+		case msg.Seq <= sub.after:
+		case sub.durable != nil:
+			sub.durable.push(msg, ev.deadline)
+		default:
+			t.deliver(sub.acc, msg, frames, ev.deadline)
+		}
+		return true
 	})
-	return
 }
 
-type Topics struct {
-	sync.Map
-	sync.Mutex
+func (t *Topic) deliver(acc *Account, msg *pb.Message, frames *frameCache, deadline time.Time) {
+	if err := acc.deliver(msg, frames, deadline); err != nil {
+		log.Warn("Topic.BroadcastLoop: write failed, topic: %s, cid: %s, err: %s", t.name, acc.ID(), err.Error())
+	}
+}
+
+// Publish queues a message, its subject may differ from the topic name when
+// the topic was subscribed with wildcards. With a deadline, for the Block
+// policy, the returned channel is closed once the message was handed to
+// every subscriber.
+func (t *Topic) Publish(msg *pb.Message, deadline time.Time) <-chan struct{} {
+	ev := &topicEvent{
+		msg:      msg,
+		deadline: deadline,
+	}
+	if !deadline.IsZero() {
+		ev.done = make(chan struct{})
+	}
+	t.enqueue(ev)
+	return ev.done
+}
+
+// enqueue queues ev for BroadcastLoop, it never blocks. A message beyond
+// the topic bounds is dropped.
+func (t *Topic) enqueue(ev *topicEvent) {
+	t.mu.Lock()
+	select {
+	case <-t.done:
+		t.mu.Unlock()
+		release([]*topicEvent{ev})
+		return
+	default:
+	}
+	if ev.msg != nil {
+		size := len(ev.msg.Data)
+		if t.queued >= topicMaxMessages || (t.queued > 0 && t.size+size > topicMaxBytes) {
+			t.mu.Unlock()
+			release([]*topicEvent{ev})
+			metrics.Dropped.Inc()
+			metrics.DroppedBytes.Add(float64(size))
+			log.Debug("Topic.enqueue: queue full, dropped message, topic: %s, seq: %d", t.name, ev.msg.Seq)
+			return
+		}
+		t.queued++
+		t.size += size
+	}
+	t.events = append(t.events, ev)
+	t.mu.Unlock()
+
+	select {
+	case t.ready <- struct{}{}:
+	default:
+	}
 }
 
-func (t *Topics) RemoveTopic(name string) {
-	t.Delete(name)
+// Stop terminates the BroadcastLoop goroutine, messages still queued are
+// dropped. Stopping a stopped topic does nothing, e.g. when a session closes
+// after StopAll.
+func (t *Topic) Stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	select {
+	case <-t.done:
+		return
+	default:
+	}
+	close(t.done)
+	release(t.events)
+	t.events = nil
+	t.queued = 0
+	t.size = 0
 }
 
-func (t *Topics) GetTopicForce(name string) *Topic {
-	var (
-		topic interface{}
-		ok    bool
-	)
-	topic, ok = t.Load(name)
-	if !ok {
-		t.Lock()
-		topic, ok = t.Load(name)
-		if !ok {
-			topic = NewTopic(name)
+// Subscribe attaches acc to the topic, it receives the messages published
+// after seq after, preceded by replay. Subscribing again without replay keeps
+// the current subscription.
+func (t *Topic) Subscribe(acc *Account, after uint64, replay []*pb.Message) {
+	if len(replay) == 0 {
+		if _, ok := t.accs.Load(acc.ID()); ok {
+			return
 		}
-		t.Unlock()
 	}
-	return topic.(*Topic)
+	sub := &subscription{
+		acc:   acc,
+		after: after,
+	}
+	t.accs.Store(acc.ID(), sub)
+	if len(replay) > 0 {
+		t.enqueue(&topicEvent{sub: sub, replay: replay})
+	}
+}
+
+// subscribeDurable keeps the messages published after seq after for d.
+func (t *Topic) subscribeDurable(d *Durable, after uint64) {
+	t.accs.Store(d.key(), &subscription{
+		durable: d,
+		after:   after,
+	})
 }
 
-var topics = &Topics{}
+func (t *Topic) UnSubscribe(id interface{}) {
+	t.accs.Delete(id)
+}
+
+func (t *Topic) Name() string {
+	return t.name
+}
+
+// Subscribers returns the number of accounts subscribed to the topic.
+func (t *Topic) Subscribers() (n int) {
+	t.accs.Range(func(key, value interface{}) bool {
+		n++
+		return true
+	})
+	return
+}
+
+func (t *Topic) HaveAccount() (exists bool) {
+	t.accs.Range(func(key, value interface{}) bool {
+		exists = true
+		return false
+	})
+	return
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/netraitcorp/netick/pb"
+	"github.com/netraitcorp/netick/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTopicQueueBounds(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		publish int
+		queued  int
+	}{
+		{name: "within bounds", size: 10, publish: 100, queued: 100},
+		{name: "max messages", size: 10, publish: topicMaxMessages + 10, queued: topicMaxMessages},
+		{name: "max bytes", size: topicMaxBytes / 4, publish: 6, queued: 4},
+		{name: "oversized first message", size: topicMaxBytes + 1, publish: 2, queued: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the broadcast loop is not started, messages stay queued
+			topic := NewTopic("topic.bounds")
+			defer topic.Stop()
+
+			before := testutil.ToFloat64(metrics.Dropped)
+			data := make([]byte, tt.size)
+			for i := 0; i < tt.publish; i++ {
+				topic.Publish(&pb.Message{Name: "topic.bounds", Seq: uint64(i + 1), Data: data}, time.Time{})
+			}
+
+			topic.mu.Lock()
+			queued := len(topic.events)
+			topic.mu.Unlock()
+			if queued != tt.queued {
+				t.Fatalf("queued %d messages, want %d", queued, tt.queued)
+			}
+			if dropped := testutil.ToFloat64(metrics.Dropped) - before; dropped != float64(tt.publish-tt.queued) {
+				t.Fatalf("dropped %v messages, want %d", dropped, tt.publish-tt.queued)
+			}
+		})
+	}
+}
+
+func TestTopicQueueReleasesDropped(t *testing.T) {
+	topic := NewTopic("topic.release")
+	defer topic.Stop()
+
+	deadline := time.Now().Add(time.Minute)
+	for i := 0; i < topicMaxMessages; i++ {
+		topic.Publish(&pb.Message{Name: "topic.release", Seq: uint64(i + 1)}, time.Time{})
+	}
+	done := topic.Publish(&pb.Message{Name: "topic.release", Seq: topicMaxMessages + 1}, deadline)
+	select {
+	case <-done:
+	default:
+		t.Fatal("publisher of a dropped message waits for it")
+	}
+
+	// a replay is queued beyond the bounds, the subscription depends on it
+	acc, _ := newTestAccount(NewOptions())
+	topic.Subscribe(acc, 0, []*pb.Message{{Name: "topic.release", Seq: 1}})
+	topic.mu.Lock()
+	queued := len(topic.events)
+	topic.mu.Unlock()
+	if queued != topicMaxMessages+1 {
+		t.Fatalf("queued %d events, want the replay queued after %d messages", queued, topicMaxMessages)
+	}
+
+	// the queue takes messages again once the broadcast loop caught up
+	topic.take()
+	done = topic.Publish(&pb.Message{Name: "topic.release", Seq: topicMaxMessages + 2}, deadline)
+	select {
+	case <-done:
+		t.Fatal("message dropped after the queue was emptied")
+	default:
+	}
+}
+
+func TestTopicStopTwice(t *testing.T) {
+	s := NewSubscribe()
+	acc, _ := newTestAccount(NewOptions())
+	s.Subscribe("topic.stop", acc, nil)
+
+	s.StopAll()
+	// the session closes after the server stopped every topic
+	s.UnSubscribeAll(acc)
+
+	if _, ok := s.Topic("topic.stop"); ok {
+		t.Fatal("topic still registered")
+	}
+}
@@ -2,7 +2,10 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"strconv"
 	"sync"
@@ -12,6 +15,8 @@ import (
 
 	"github.com/gorilla/websocket"
 	"github.com/netraitcorp/netick/pkg/log"
+	"github.com/netraitcorp/netick/pkg/metrics"
+	"github.com/netraitcorp/netick/pkg/types"
 )
 
 type WebsocketConn struct {
@@ -19,7 +24,9 @@ type WebsocketConn struct {
 	conn      *websocket.Conn
 	ping      pingt
 	connID    string
-	buf       chan []byte
+	queue     *sendQueue
+	codec     Codec
+	msgType   int
 	handler   Handler
 	cancelCtx context.CancelFunc
 	closed    bool
@@ -33,16 +40,28 @@ func NewWebsocketConn(conn *websocket.Conn, srv Server) *WebsocketConn {
 		srv:    srv,
 		conn:   conn,
 		connID: util.Sha1(rawConnKey + strconv.Itoa(util.RandInt())),
-		buf:    make(chan []byte, 0x40),
+		codec:  codecByName(conn.Subprotocol()),
 		closed: false,
 	}
+	c.msgType = websocket.BinaryMessage
+	if c.codec == jsonPacket {
+		c.msgType = websocket.TextMessage
+	}
+	if err := conn.SetCompressionLevel(srv.Options().Compression.Level); err != nil {
+		log.Warn("NewWebsocketConn: %s, cid: %s", err.Error(), c.ConnID())
+	}
+	if maxSize := srv.Options().MaxFrameSize; maxSize > 0 {
+		conn.SetReadLimit(int64(maxSize))
+	}
+	c.queue = newSendQueue(c.connID)
 	c.handler = NewReadHandler(c)
 	c.handler.CreateConn()
+	metrics.Connections.WithLabelValues(metrics.TransportWebsocket).Inc()
 
 	c.conn.SetPongHandler(c.pongHandler)
 	c.startPingTimer()
 
-	log.Info("NewWebsocketConn: %s, cid: %s", rawConnKey, c.ConnID())
+	log.Info("NewWebsocketConn: %s, codec: %s, cid: %s", rawConnKey, c.codec.Name(), c.ConnID())
 
 	return c
 }
@@ -63,15 +82,32 @@ func (c *WebsocketConn) RemoteAddr() net.Addr {
 	return c.conn.RemoteAddr()
 }
 
+func (c *WebsocketConn) TLSState() *tls.ConnectionState {
+	if tc, ok := c.conn.UnderlyingConn().(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		return &state
+	}
+	return nil
+}
+
 func (c *WebsocketConn) Accept() {
 	ctx, cancelCtx := context.WithCancel(context.Background())
 	c.cancelCtx = cancelCtx
 
-	readCtx, _ := context.WithCancel(ctx)
-	go c.loopRead(readCtx)
+	go c.loopRead(ctx)
+	go c.loopWrite(ctx)
+}
+
+func (c *WebsocketConn) Buffered() int {
+	return c.queue.buffered()
+}
+
+func (c *WebsocketConn) SlowConsumer() SlowConsumerStats {
+	return c.queue.slowConsumer()
+}
 
-	writeCtx, _ := context.WithCancel(ctx)
-	go c.loopWrite(writeCtx)
+func (c *WebsocketConn) Unsent() [][]byte {
+	return c.queue.drain()
 }
 
 func (c *WebsocketConn) Closed() bool {
@@ -98,10 +134,9 @@ func (c *WebsocketConn) Close() error {
 		c.handler.Close()
 	}
 
-	if c.ping.timer != nil {
-		c.ping.timer.Stop()
-		c.ping.timer = nil
-	}
+	c.ping.stop()
+	c.queue.close()
+	metrics.Connections.WithLabelValues(metrics.TransportWebsocket).Dec()
 
 	log.Info("CloseWebsocketConn: cid: %s", c.ConnID())
 
@@ -109,20 +144,19 @@ func (c *WebsocketConn) Close() error {
 }
 
 func (c *WebsocketConn) Write(data []byte) error {
+	return c.Send(data, c.srv.Options().SlowConsumer.Policy, time.Time{})
+}
+
+func (c *WebsocketConn) Send(data []byte, policy SlowConsumerPolicy, deadline time.Time) error {
 	if c.closed {
-		return fmt.Errorf("WebsocketConn.Write: connection closed")
-	}
-	select {
-	case c.buf <- data:
-		return nil
-	default:
-		return fmt.Errorf("WebsocketConn.Write: write buf full")
+		return fmt.Errorf("WebsocketConn.Send: connection closed")
 	}
+	return enqueue(c, c.queue, data, policy, deadline)
 }
 
 func (c *WebsocketConn) loopRead(ctx context.Context) {
 	for {
-		_, data, err := c.conn.ReadMessage()
+		data, err := c.readMessage()
 		select {
 		case <-ctx.Done():
 			return
@@ -142,20 +176,46 @@ func (c *WebsocketConn) loopRead(ctx context.Context) {
 		if c.handler != nil {
 			if err := c.handler.ReadData(data); err != nil {
 				log.Error("Handler.ReadData error: cid: %s, err:%s", c.ConnID(), err.Error())
-				_ = c.Close()
+				flushAndClose(c)
 				return
 			}
 		}
 	}
 }
 
+// readMessage reads the next message. The read limit of the connection
+// bounds the frames as received, the decompressed message is bounded by
+// MaxFrameSize as well.
+func (c *WebsocketConn) readMessage() ([]byte, error) {
+	_, r, err := c.conn.NextReader()
+	if err != nil {
+		return nil, err
+	}
+	maxSize := c.srv.Options().MaxFrameSize
+	if maxSize <= 0 {
+		return ioutil.ReadAll(r)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxSize {
+		return nil, fmt.Errorf("WebsocketConn.readMessage: message exceeds the limit of %d bytes", maxSize)
+	}
+	return data, nil
+}
+
 func (c *WebsocketConn) loopWrite(ctx context.Context) {
 	for {
 		select {
-		case data := <-c.buf:
-			d := time.Duration(len(data)/0x19000)*time.Second + writeWait
-			_ = c.conn.SetWriteDeadline(time.Now().Add(d))
-			if err := c.conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		case <-c.queue.ready:
+			frames := coalesce(ctx, c.queue, c.srv.Options().Batch)
+			if len(frames) == 0 {
+				continue
+			}
+			err := c.writeFrames(frames)
+			c.queue.written(len(frames))
+			if err != nil {
 				log.Error("Write error: cid: %s, err: %s", c.ConnID(), err.Error())
 
 				_ = c.Close()
@@ -167,40 +227,88 @@ func (c *WebsocketConn) loopWrite(ctx context.Context) {
 	}
 }
 
+// writeFrames sends frames in a single batch frame when the client
+// negotiated FeatureBatching, one message each otherwise.
+func (c *WebsocketConn) writeFrames(frames [][]byte) error {
+	if len(frames) > 1 && c.handler.Features()&types.FeatureBatching != 0 {
+		data, err := batchFrame(c.codec, frames)
+		if err != nil {
+			return err
+		}
+		frames = [][]byte{data}
+	}
+
+	// only takes effect when the client negotiated permessage-deflate
+	threshold := c.srv.Options().Compression.Threshold
+	for _, data := range frames {
+		d := time.Duration(len(data)/0x19000)*time.Second + writeWait
+		_ = c.conn.SetWriteDeadline(time.Now().Add(d))
+		c.conn.EnableWriteCompression(threshold > 0 && len(data) >= threshold)
+		if err := c.conn.WriteMessage(c.msgType, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *WebsocketConn) Codec() Codec {
+	return c.codec
+}
+
+func (c *WebsocketConn) Heartbeat(rtt time.Duration) {
+	c.ping.seen(rtt)
+	if rtt > 0 {
+		metrics.PingRTT.WithLabelValues(metrics.TransportWebsocket).Observe(rtt.Seconds())
+	}
+}
+
+func (c *WebsocketConn) RTT() time.Duration {
+	return c.ping.roundTrip()
+}
+
 func (c *WebsocketConn) startPingTimer() {
-	d := c.srv.Options().PingInterval
-	c.ping.timer = time.AfterFunc(d, c.loopPingTimer)
-	c.ping.lastp = time.Now()
+	c.ping.seen(0)
+	c.ping.schedule(c.srv.Options().PingInterval, c.loopPingTimer)
 }
 
 func (c *WebsocketConn) loopPingTimer() {
-	c.ping.timer = nil
-
 	if c.closed {
 		return
 	}
 
-	d := c.srv.Options().PingInterval * time.Duration(c.srv.Options().MaxPingOutTimes)
-	n := time.Now().Add(-d)
-	if c.ping.lastp.Before(n) {
+	opts := c.srv.Options()
+	if c.ping.timedOut(opts) {
+		log.Info("LoopPingTimer: ping timeout, cid: %s", c.ConnID())
 		_ = c.Close()
 		return
 	}
 
-	err := c.conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(writeWait))
+	// clients behind proxies stripping control frames are pinged with
+	// opcode level frames instead
+	var err error
+	if opts.Websocket.AppPing {
+		var data []byte
+		if data, err = pingFrame(c.codec); err == nil {
+			err = c.Write(data)
+		}
+	} else {
+		ts := strconv.FormatInt(time.Now().UnixNano(), 10)
+		err = c.conn.WriteControl(websocket.PingMessage, []byte(ts), time.Now().Add(writeWait))
+	}
 	if err != nil {
 		log.Warn("LoopPingTimer: writePingMessage failed, cid: %s, %s", c.ConnID(), err.Error())
 		_ = c.Close()
 		return
 	}
 
-	dd := c.srv.Options().PingInterval
-	c.ping.timer = time.AfterFunc(dd, c.loopPingTimer)
+	c.ping.schedule(opts.PingInterval, c.loopPingTimer)
 }
 
-func (c *WebsocketConn) pongHandler(string) error {
-	c.ping.lastp = time.Now()
+func (c *WebsocketConn) pongHandler(appData string) error {
+	ts, _ := strconv.ParseInt(appData, 10, 64)
+	rtt := sinceTimestamp(ts)
+	c.ping.seen(rtt)
 
-	log.Debug("PongHandler: %s", c.ping.lastp.String())
+	log.Debug("PongHandler: cid: %s, rtt: %s", c.ConnID(), rtt.String())
 	return nil
 }
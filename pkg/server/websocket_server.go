@@ -1,7 +1,10 @@
 package server
 
 import (
+	"context"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -9,27 +12,61 @@ import (
 )
 
 type WebsocketServer struct {
-	opts     *Options
+	opts     atomic.Value
 	addr     string
 	rt       time.Duration
 	wt       time.Duration
+	tls      *TLSOptions
 	httpSrv  *http.Server
 	upgrader *websocket.Upgrader
+	mu       sync.Mutex
 }
 
 func (srv *WebsocketServer) ListenAndServe() error {
-	srv.httpSrv = &http.Server{
+	httpSrv := &http.Server{
 		Addr:         srv.addr,
 		Handler:      srv,
 		ReadTimeout:  srv.rt,
 		WriteTimeout: srv.wt,
 	}
-	if err := srv.httpSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	if srv.tls != nil {
+		cfg, err := srv.tls.TLSConfig()
+		if err != nil {
+			return err
+		}
+		httpSrv.TLSConfig = cfg
+	}
+
+	srv.mu.Lock()
+	srv.httpSrv = httpSrv
+	srv.mu.Unlock()
+
+	var err error
+	if httpSrv.TLSConfig != nil {
+		err = httpSrv.ListenAndServeTLS("", "")
+	} else {
+		err = httpSrv.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
 		return err
 	}
 	return nil
 }
 
+// Shutdown stops accepting new connections, established websocket
+// connections are hijacked from the http server and must be drained with
+// DrainConns.
+func (srv *WebsocketServer) Shutdown(ctx context.Context) error {
+	srv.mu.Lock()
+	httpSrv := srv.httpSrv
+	srv.mu.Unlock()
+
+	if httpSrv == nil {
+		return nil
+	}
+	return httpSrv.Shutdown(ctx)
+}
+
 func (srv *WebsocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	wsConn, err := srv.upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -42,24 +79,38 @@ func (srv *WebsocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (srv *WebsocketServer) Options() *Options {
-	return srv.opts
+	return srv.opts.Load().(*Options)
 }
 
-func RunWebsocketServer(opts *Options) error {
+func (srv *WebsocketServer) Reload(opts *Options) {
+	srv.opts.Store(opts)
+}
+
+func NewWebsocketServer(opts *Options) *WebsocketServer {
 	upgrader := &websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
+		Subprotocols:    []string{CodecProto, CodecJSON},
+		// permessage-deflate is offered to every client, whether a frame
+		// is compressed is decided by the compression options on write
+		EnableCompression: true,
 		CheckOrigin: func(r *http.Request) bool {
 			return true
 		},
 	}
 
 	srv := &WebsocketServer{
-		opts:     opts,
 		addr:     opts.Websocket.Addr,
 		rt:       opts.Websocket.ReadTimeout,
 		wt:       opts.Websocket.WriteTimeout,
+		tls:      opts.Websocket.TLS,
 		upgrader: upgrader,
 	}
-	return srv.ListenAndServe()
+	srv.opts.Store(opts)
+	return srv
+}
+
+func RunWebsocketServer(opts *Options) error {
+	Configure(opts)
+	return NewWebsocketServer(opts).ListenAndServe()
 }
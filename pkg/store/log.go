@@ -0,0 +1,479 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/netraitcorp/netick/pkg/log"
+)
+
+// SyncPolicy decides when appended records are flushed to stable storage.
+type SyncPolicy int
+
+const (
+	// SyncInterval fsyncs the active segment every Options.SyncInterval.
+	SyncInterval SyncPolicy = iota
+	// SyncAlways fsyncs after every record.
+	SyncAlways
+	// SyncNever leaves writing back to the disk to the operating system.
+	SyncNever
+)
+
+var syncPolicyNames = map[SyncPolicy]string{
+	SyncInterval: "interval",
+	SyncAlways:   "always",
+	SyncNever:    "never",
+}
+
+func (p SyncPolicy) String() string {
+	if name, ok := syncPolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("SyncPolicy(%d)", int(p))
+}
+
+// ParseSyncPolicy converts the textual policy used in the configuration file.
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	for p, name := range syncPolicyNames {
+		if name == s {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown sync policy %q, expected interval, always or never", s)
+}
+
+type Options struct {
+	// Dir holds the segment files, empty disables the log.
+	Dir string
+	// SegmentSize in bytes, a new segment is started once it is exceeded.
+	SegmentSize int64
+	// MaxBytes of all segments, 0 is unbounded.
+	MaxBytes int64
+	// MaxAge of a segment since its last write, 0 is unbounded. The active
+	// segment is rolled once it is older, so its records expire as well.
+	MaxAge       time.Duration
+	Sync         SyncPolicy
+	SyncInterval time.Duration
+}
+
+func NewOptions() *Options {
+	return &Options{
+		SegmentSize:  64 * 1024 * 1024,
+		MaxBytes:     0,
+		MaxAge:       7 * 24 * time.Hour,
+		Sync:         SyncInterval,
+		SyncInterval: time.Second,
+	}
+}
+
+const (
+	segmentExt = ".log"
+	// recordHeadSize is the length and the CRC-32C of the payload.
+	recordHeadSize = 8
+	maxRecordSize  = 1 << 30
+	// retentionInterval is the period retention is enforced at besides on
+	// roll, so that segments expire without traffic.
+	retentionInterval = time.Minute
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type segment struct {
+	id      uint64
+	path    string
+	size    int64
+	created time.Time
+	modTime time.Time
+}
+
+// Log is an append-only sequence of records split into segment files. The
+// segments are removed oldest first once they exceed the retention, checked
+// on roll and periodically.
+type Log struct {
+	opts     *Options
+	mu       sync.Mutex
+	segments []*segment
+	active   *os.File
+	w        *bufio.Writer
+	dirty    bool
+	onRoll   func() [][]byte
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// Open recovers the log found in opts.Dir, creating the directory if needed.
+// A record cut short or failing its checksum, as left by a crash, is
+// truncated along with the rest of its segment.
+func Open(opts *Options) (*Log, error) {
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("Log.Open: %s", err.Error())
+	}
+	l := &Log{
+		opts: opts,
+		done: make(chan struct{}),
+	}
+	if err := l.recover(); err != nil {
+		return nil, err
+	}
+	// retention is not enforced before OnRoll is set, segments are only
+	// removed once a newer one starts with its records
+	if n := len(l.segments); n > 0 {
+		if err := l.open(l.segments[n-1]); err != nil {
+			return nil, err
+		}
+	} else if err := l.roll(); err != nil {
+		return nil, err
+	}
+
+	l.wg.Add(1)
+	go l.loop(l.done)
+	return l, nil
+}
+
+func (l *Log) recover() error {
+	infos, err := ioutil.ReadDir(l.opts.Dir)
+	if err != nil {
+		return fmt.Errorf("Log.recover: %s", err.Error())
+	}
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		seg := &segment{
+			id:      id,
+			path:    filepath.Join(l.opts.Dir, name),
+			size:    info.Size(),
+			created: info.ModTime(),
+			modTime: info.ModTime(),
+		}
+		valid, err := scanSegment(seg.path, nil)
+		if err != nil && err != errCorrupt {
+			return fmt.Errorf("Log.recover: %s", err.Error())
+		}
+		if valid < seg.size {
+			log.Warn("Log.recover: truncating segment %s at %d of %d bytes", seg.path, valid, seg.size)
+			if err := os.Truncate(seg.path, valid); err != nil {
+				return fmt.Errorf("Log.recover: %s", err.Error())
+			}
+			seg.size = valid
+		}
+		l.segments = append(l.segments, seg)
+	}
+	sort.Slice(l.segments, func(i, j int) bool {
+		return l.segments[i].id < l.segments[j].id
+	})
+	return nil
+}
+
+var errCorrupt = fmt.Errorf("corrupt record")
+
+// scanSegment calls fn for every record of the segment and returns the size
+// of its valid prefix.
+func scanSegment(path string, fn func(data []byte) error) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	head := make([]byte, recordHeadSize)
+	var valid int64
+	for {
+		if _, err := io.ReadFull(r, head); err != nil {
+			if err == io.EOF {
+				return valid, nil
+			}
+			return valid, errCorrupt
+		}
+		n := binary.BigEndian.Uint32(head)
+		if n > maxRecordSize {
+			return valid, errCorrupt
+		}
+		data := make([]byte, n)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return valid, errCorrupt
+		}
+		if crc32.Checksum(data, crcTable) != binary.BigEndian.Uint32(head[4:]) {
+			return valid, errCorrupt
+		}
+		if fn != nil {
+			if err := fn(data); err != nil {
+				return valid, err
+			}
+		}
+		valid += int64(recordHeadSize + n)
+	}
+}
+
+// OnRoll sets f to provide the records written at the start of every new
+// segment, e.g. a snapshot of state that must outlive the retention.
+func (l *Log) OnRoll(f func() [][]byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.onRoll = f
+}
+
+// Replay calls fn for every record, oldest first.
+func (l *Log) Replay(fn func(data []byte) error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.flush(); err != nil {
+		return err
+	}
+	for _, seg := range l.segments {
+		if _, err := scanSegment(seg.path, fn); err != nil {
+			return fmt.Errorf("Log.Replay: segment %s: %s", seg.path, err.Error())
+		}
+	}
+	return nil
+}
+
+// Append writes a record and flushes it to the segment file, so it survives
+// a crash of the process. It survives a crash of the system according to the
+// sync policy.
+func (l *Log) Append(data []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.active == nil {
+		return fmt.Errorf("Log.Append: log closed")
+	}
+	if l.segments[len(l.segments)-1].size >= l.opts.SegmentSize {
+		if err := l.roll(); err != nil {
+			return err
+		}
+		l.enforceRetention()
+	}
+	if err := l.write(data); err != nil {
+		return err
+	}
+	if l.opts.Sync == SyncAlways {
+		return l.sync()
+	}
+	return l.flush()
+}
+
+func (l *Log) write(data []byte) error {
+	head := make([]byte, recordHeadSize)
+	binary.BigEndian.PutUint32(head, uint32(len(data)))
+	binary.BigEndian.PutUint32(head[4:], crc32.Checksum(data, crcTable))
+	if _, err := l.w.Write(head); err != nil {
+		return fmt.Errorf("Log.write: %s", err.Error())
+	}
+	if _, err := l.w.Write(data); err != nil {
+		return fmt.Errorf("Log.write: %s", err.Error())
+	}
+
+	seg := l.segments[len(l.segments)-1]
+	seg.size += int64(recordHeadSize + len(data))
+	seg.modTime = time.Now()
+	l.dirty = true
+	return nil
+}
+
+// roll closes the active segment and starts a new one.
+func (l *Log) roll() error {
+	if l.active != nil {
+		if err := l.sync(); err != nil {
+			return err
+		}
+		if err := l.active.Close(); err != nil {
+			return fmt.Errorf("Log.roll: %s", err.Error())
+		}
+		l.active = nil
+	}
+
+	var id uint64 = 1
+	if n := len(l.segments); n > 0 {
+		id = l.segments[n-1].id + 1
+	}
+	now := time.Now()
+	seg := &segment{
+		id:      id,
+		path:    filepath.Join(l.opts.Dir, fmt.Sprintf("%020d%s", id, segmentExt)),
+		created: now,
+		modTime: now,
+	}
+	if err := l.open(seg); err != nil {
+		return err
+	}
+	l.segments = append(l.segments, seg)
+
+	if l.onRoll != nil {
+		for _, data := range l.onRoll() {
+			if err := l.write(data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (l *Log) open(seg *segment) error {
+	f, err := os.OpenFile(seg.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("Log.open: %s", err.Error())
+	}
+	l.active = f
+	l.w = bufio.NewWriter(f)
+	return nil
+}
+
+// enforceRetention removes the oldest segments exceeding MaxBytes or MaxAge,
+// the active segment is always kept.
+func (l *Log) enforceRetention() {
+	var total int64
+	for _, seg := range l.segments {
+		total += seg.size
+	}
+
+	n := 0
+	for n < len(l.segments)-1 {
+		seg := l.segments[n]
+		expired := l.opts.MaxAge > 0 && time.Since(seg.modTime) > l.opts.MaxAge
+		if !expired && (l.opts.MaxBytes <= 0 || total <= l.opts.MaxBytes) {
+			break
+		}
+		if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+			log.Error("Log.enforceRetention: remove segment %s failed, err: %s", seg.path, err.Error())
+			break
+		}
+		log.Debug("Log.enforceRetention: removed segment %s", seg.path)
+		total -= seg.size
+		n++
+	}
+	l.segments = l.segments[n:]
+}
+
+func (l *Log) flush() error {
+	if l.w == nil {
+		return nil
+	}
+	if err := l.w.Flush(); err != nil {
+		return fmt.Errorf("Log.flush: %s", err.Error())
+	}
+	return nil
+}
+
+func (l *Log) sync() error {
+	if !l.dirty {
+		return nil
+	}
+	if err := l.flush(); err != nil {
+		return err
+	}
+	if l.opts.Sync != SyncNever {
+		if err := l.active.Sync(); err != nil {
+			return fmt.Errorf("Log.sync: %s", err.Error())
+		}
+	}
+	l.dirty = false
+	return nil
+}
+
+// Sync flushes the appended records to stable storage.
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.active == nil {
+		return nil
+	}
+	return l.sync()
+}
+
+// EnforceRetention removes the segments beyond the retention, the active
+// segment is rolled first once it is older than MaxAge. It is called
+// periodically by the log, once OnRoll is set.
+func (l *Log) EnforceRetention() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.active == nil || l.onRoll == nil {
+		return nil
+	}
+	seg := l.segments[len(l.segments)-1]
+	if l.opts.MaxAge > 0 && seg.size > 0 && time.Since(seg.created) > l.opts.MaxAge {
+		if err := l.roll(); err != nil {
+			return err
+		}
+		if err := l.sync(); err != nil {
+			return err
+		}
+	}
+	l.enforceRetention()
+	return nil
+}
+
+// loop syncs the log under SyncInterval and enforces the retention.
+func (l *Log) loop(done chan struct{}) {
+	defer l.wg.Done()
+
+	var syncc <-chan time.Time
+	if l.opts.Sync == SyncInterval && l.opts.SyncInterval > 0 {
+		ticker := time.NewTicker(l.opts.SyncInterval)
+		defer ticker.Stop()
+		syncc = ticker.C
+	}
+	retention := time.NewTicker(retentionInterval)
+	defer retention.Stop()
+
+	for {
+		select {
+		case <-syncc:
+			if err := l.Sync(); err != nil {
+				log.Error("Log.loop: %s", err.Error())
+			}
+		case <-retention.C:
+			if err := l.EnforceRetention(); err != nil {
+				log.Error("Log.loop: %s", err.Error())
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// Close syncs and closes the active segment.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	if l.active == nil || l.done == nil {
+		l.mu.Unlock()
+		return nil
+	}
+	close(l.done)
+	l.done = nil
+	l.mu.Unlock()
+	l.wg.Wait()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.dirty = true
+	err := l.sync()
+	if cerr := l.active.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("Log.Close: %s", cerr.Error())
+	}
+	l.active = nil
+	l.w = nil
+	return err
+}
@@ -0,0 +1,328 @@
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/netraitcorp/netick/pkg/log"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "netick-log")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	opts := log.NewOptions()
+	opts.Filename = filepath.Join(dir, "netick.log")
+	opts.Level = "error"
+	log.Init(opts)
+
+	code := m.Run()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func openLog(t *testing.T, dir string, opts *Options) *Log {
+	t.Helper()
+	opts.Dir = dir
+	l, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Open: %s", err.Error())
+	}
+	return l
+}
+
+func testOptions() *Options {
+	opts := NewOptions()
+	opts.Sync = SyncNever
+	return opts
+}
+
+func replay(t *testing.T, l *Log) []string {
+	t.Helper()
+	var records []string
+	err := l.Replay(func(data []byte) error {
+		records = append(records, string(data))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Replay: %s", err.Error())
+	}
+	return records
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func appendAll(t *testing.T, l *Log, records ...string) {
+	t.Helper()
+	for _, r := range records {
+		if err := l.Append([]byte(r)); err != nil {
+			t.Fatalf("Append %q: %s", r, err.Error())
+		}
+	}
+}
+
+func segmentPaths(t *testing.T, dir string) []string {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return paths
+}
+
+func TestLogReplayOrder(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "netick-store")
+	defer os.RemoveAll(dir)
+
+	opts := testOptions()
+	opts.SegmentSize = 32
+	l := openLog(t, dir, opts)
+	l.OnRoll(func() [][]byte { return nil })
+
+	var want []string
+	for i := 0; i < 20; i++ {
+		want = append(want, fmt.Sprintf("record-%02d", i))
+	}
+	appendAll(t, l, want...)
+
+	if got := replay(t, l); !equal(got, want) {
+		t.Fatalf("Replay before reopen = %v, want %v", got, want)
+	}
+	if n := len(segmentPaths(t, dir)); n < 2 {
+		t.Fatalf("got %d segments, want records spread over several", n)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	l = openLog(t, dir, testOptions())
+	defer l.Close()
+	if got := replay(t, l); !equal(got, want) {
+		t.Fatalf("Replay after reopen = %v, want %v", got, want)
+	}
+}
+
+func TestLogAppendFlushes(t *testing.T) {
+	for _, policy := range []SyncPolicy{SyncInterval, SyncAlways, SyncNever} {
+		t.Run(policy.String(), func(t *testing.T) {
+			dir, _ := ioutil.TempDir("", "netick-store")
+			defer os.RemoveAll(dir)
+
+			opts := testOptions()
+			opts.Sync = policy
+			opts.SyncInterval = time.Hour
+			l := openLog(t, dir, opts)
+			defer l.Close()
+
+			records := []string{"first", "second", "third"}
+			appendAll(t, l, records...)
+
+			// read the file behind the log, as after a crash of the process
+			paths := segmentPaths(t, dir)
+			if len(paths) != 1 {
+				t.Fatalf("got %d segments, want 1", len(paths))
+			}
+			var got []string
+			_, err := scanSegment(paths[0], func(data []byte) error {
+				got = append(got, string(data))
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !equal(got, records) {
+				t.Fatalf("segment file holds %v, want %v", got, records)
+			}
+		})
+	}
+}
+
+func TestLogRecoverCorruption(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(data []byte) []byte
+		want    []string
+	}{
+		{
+			name: "torn tail",
+			corrupt: func(data []byte) []byte {
+				return data[:len(data)-3]
+			},
+			want: []string{"first", "second"},
+		},
+		{
+			name: "torn head",
+			corrupt: func(data []byte) []byte {
+				return append(data, 0, 0, 0)
+			},
+			want: []string{"first", "second", "third"},
+		},
+		{
+			name: "bad crc",
+			corrupt: func(data []byte) []byte {
+				data[len(data)-1] ^= 0xFF
+				return data
+			},
+			want: []string{"first", "second"},
+		},
+		{
+			name: "oversized length",
+			corrupt: func(data []byte) []byte {
+				return append(data, 0xFF, 0xFF, 0xFF, 0xFF, 0, 0, 0, 0)
+			},
+			want: []string{"first", "second", "third"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, _ := ioutil.TempDir("", "netick-store")
+			defer os.RemoveAll(dir)
+
+			l := openLog(t, dir, testOptions())
+			appendAll(t, l, "first", "second", "third")
+			if err := l.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			paths := segmentPaths(t, dir)
+			if len(paths) != 1 {
+				t.Fatalf("got %d segments, want 1", len(paths))
+			}
+			data, err := ioutil.ReadFile(paths[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(paths[0], tt.corrupt(data), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			valid, err := scanSegment(paths[0], nil)
+			if err != errCorrupt {
+				t.Fatalf("scanSegment error = %v, want %v", err, errCorrupt)
+			}
+
+			l = openLog(t, dir, testOptions())
+			if got := replay(t, l); !equal(got, tt.want) {
+				t.Fatalf("Replay = %v, want %v", got, tt.want)
+			}
+			info, err := os.Stat(paths[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() != valid {
+				t.Fatalf("segment size = %d, want truncated to %d", info.Size(), valid)
+			}
+
+			// the log keeps appending after the truncated record
+			appendAll(t, l, "fourth")
+			if err := l.Close(); err != nil {
+				t.Fatal(err)
+			}
+			l = openLog(t, dir, testOptions())
+			defer l.Close()
+			want := append(tt.want, "fourth")
+			if got := replay(t, l); !equal(got, want) {
+				t.Fatalf("Replay after append = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestLogRetentionKeepsSnapshot(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    func(opts *Options)
+		enforce bool
+	}{
+		{
+			name: "max bytes on roll",
+			opts: func(opts *Options) {
+				opts.SegmentSize = 64
+				opts.MaxBytes = 128
+			},
+		},
+		{
+			name: "max age on timer",
+			opts: func(opts *Options) {
+				opts.MaxAge = 20 * time.Millisecond
+			},
+			enforce: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, _ := ioutil.TempDir("", "netick-store")
+			defer os.RemoveAll(dir)
+
+			opts := testOptions()
+			tt.opts(opts)
+			l := openLog(t, dir, opts)
+			defer l.Close()
+
+			l.OnRoll(func() [][]byte { return [][]byte{[]byte("retained")} })
+
+			for i := 1; i <= 20; i++ {
+				appendAll(t, l, fmt.Sprintf("old-%02d", i))
+			}
+			if tt.enforce {
+				time.Sleep(2 * opts.MaxAge)
+				if err := l.EnforceRetention(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			appendAll(t, l, "new")
+
+			got := replay(t, l)
+			if len(got) == 0 || got[len(got)-1] != "new" {
+				t.Fatalf("Replay = %v, want the last record to be new", got)
+			}
+			if got[0] == "old-01" {
+				t.Fatalf("Replay = %v, want the oldest segment removed", got)
+			}
+			found := false
+			for _, r := range got {
+				found = found || r == "retained"
+			}
+			if !found {
+				t.Fatalf("Replay = %v, want the retained snapshot kept", got)
+			}
+		})
+	}
+}
+
+func TestLogRetentionWaitsForOnRoll(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "netick-store")
+	defer os.RemoveAll(dir)
+
+	opts := testOptions()
+	opts.MaxAge = time.Millisecond
+	l := openLog(t, dir, opts)
+	defer l.Close()
+
+	appendAll(t, l, "first")
+	time.Sleep(5 * time.Millisecond)
+	if err := l.EnforceRetention(); err != nil {
+		t.Fatal(err)
+	}
+	if got := replay(t, l); !equal(got, []string{"first"}) {
+		t.Fatalf("Replay = %v, want records kept until OnRoll is set", got)
+	}
+}
@@ -3,10 +3,22 @@ package types
 type OpCode uint8
 
 const (
-	OpUnknown   = 0x00
-	OpPing      = 0x01
-	OpPong      = 0x02
-	OpAuth      = 0x04
-	OpAuthRet   = 0x05
-	OpSubscribe = 0x06
+	OpUnknown        = 0x00
+	OpPing           = 0x01
+	OpPong           = 0x02
+	OpHello          = 0x03
+	OpAuth           = 0x04
+	OpAuthRet        = 0x05
+	OpSubscribe      = 0x06
+	OpPublish        = 0x07
+	OpMessage        = 0x08
+	OpUnsubscribe    = 0x09
+	OpUnsubscribeRet = 0x0A
+	OpGoAway         = 0x0B
+	OpError          = 0x0C
+	OpAck            = 0x0D
+	OpHelloRet       = 0x0E
+	OpBatch          = 0x0F
+	OpMessageAck     = 0x10
+	OpResume         = 0x11
 )
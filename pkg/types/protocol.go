@@ -0,0 +1,22 @@
+package types
+
+// ProtocolVersion is the wire protocol version spoken by the server, clients
+// down to MinProtocolVersion are accepted.
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+)
+
+// Feature flags advertised in the hello exchange, the features in use are
+// the ones both sides advertised. FeatureCompression enables the compressed
+// flag of TCP frames, websocket connections negotiate permessage-deflate
+// instead. FeatureResume asks for a resume token in AuthResp.
+const (
+	FeatureCompression = 1 << 0
+	FeatureBatching    = 1 << 1
+	FeatureAcks        = 1 << 2
+	FeatureResume      = 1 << 3
+)
+
+// ServerFeatures lists the features this server implements.
+const ServerFeatures = FeatureCompression | FeatureBatching | FeatureAcks | FeatureResume